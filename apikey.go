@@ -0,0 +1,239 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"time"
+	"net/http"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+//
+// what an API key may do, from its [apikey.<name>] section. Everything is allowed unless restricted:
+//
+//   enabled = false                     the key is refused
+//   expires = 2027-01-01                refused from then on; a date or RFC 3339 time
+//   dataids = location, sensor.*        data IDs the key may publish, with path.Match wildcards
+//   methods = POST                      HTTP methods
+//   cidrs   = 10.0.0.0/8, 192.0.2.1     source addresses
+//
+
+//
+// keys in [apikeys] are either plaintext or hashed as 'sha256:<salt>:<hash>', with salt and hash in hex and
+// hash = HMAC-SHA256(pepper, salt + key). The pepper comes from [security] so a leaked config file alone isn't
+// enough to brute force the keys. 'iftt-mqtt-webhook genkey <name>' makes a key and its line for the config
+//
+
+const (
+	apiKeyHashPrefix		string = "sha256:"
+	apiKeySaltSize			int = 16
+	apiKeySize				int = 32
+)
+
+var (
+	errKeyDisabled			= errors.New("API key disabled")
+	errKeyExpired			= errors.New("API key expired")
+)
+
+//
+//
+func newAPIKey(name string, value string) (*apiKey, error) {
+	key := &apiKey{name: name, enabled: true}
+
+	if !strings.HasPrefix(value, apiKeyHashPrefix) {
+		key.key = value
+		return key, nil
+	}
+
+	f := strings.Split(strings.TrimPrefix(value, apiKeyHashPrefix), ":")
+	if len(f) != 2 {
+		return nil, errors.New("expected 'sha256:<salt>:<hash>'")
+	}
+
+	var err error
+
+	if key.salt, err = hex.DecodeString(f[0]); err != nil {
+		return nil, errors.New("invalid salt")
+	}
+
+	if key.hash, err = hex.DecodeString(f[1]); err != nil || len(key.hash) != sha256.Size {
+		return nil, errors.New("invalid hash")
+	}
+
+	return key, nil
+}
+//
+// constant time; plaintext keys are compared by their SHA-256 so the length doesn't leak either
+//
+func (key *apiKey) matches(candidate string, pepper []byte) bool {
+	if key.hash != nil {
+		return hmac.Equal(hashAPIKey(candidate, key.salt, pepper), key.hash)
+	}
+
+	a := sha256.Sum256([]byte(candidate))
+	b := sha256.Sum256([]byte(key.key))
+
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+//
+//
+func hashAPIKey(key string, salt []byte, pepper []byte) []byte {
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write(salt)
+	mac.Write([]byte(key))
+
+	return mac.Sum(nil)
+}
+//
+// returns a new random key, URL safe since it may end up in the path, and its hashed form for [apikeys]
+//
+func generateAPIKey(pepper []byte) (key string, hashed string, err error) {
+	b    := make([]byte, apiKeySize)
+	salt := make([]byte, apiKeySaltSize)
+
+	if _, err = rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	if _, err = rand.Read(salt); err != nil {
+		return "", "", err
+	}
+
+	key    = base64.RawURLEncoding.EncodeToString(b)
+	hashed = apiKeyHashPrefix + hex.EncodeToString(salt) + ":" + hex.EncodeToString(hashAPIKey(key, salt, pepper))
+
+	return key, hashed, nil
+}
+//
+// ip is the client address, which behind a trusted proxy isn't the address of the connection
+//
+func (key *apiKey) authorize(r *http.Request, ip net.IP, dataId string) error {
+	if !key.enabled {
+		return errKeyDisabled
+	}
+
+	if !key.expires.IsZero() && time.Now().After(key.expires) {
+		return errKeyExpired
+	}
+
+	if len(key.methods) > 0 && !containsString(key.methods, r.Method) {
+		return fmt.Errorf("method %s not allowed for this API key", r.Method)
+	}
+
+	if len(key.networks) > 0 && !key.allowsAddress(ip) {
+		return errors.New("source address not allowed for this API key")
+	}
+
+	if len(key.dataIds) > 0 && !key.allowsDataId(dataId) {
+		return fmt.Errorf("data ID '%s' not allowed for this API key", dataId)
+	}
+
+	return nil
+}
+//
+//
+func (key *apiKey) allowsDataId(dataId string) bool {
+	for _, pattern := range key.dataIds {
+		if ok, _ := path.Match(pattern, dataId); ok {
+			return true
+		}
+	}
+
+	return false
+}
+//
+//
+func (key *apiKey) allowsAddress(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range key.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+//
+// a bare address is taken as a single host
+//
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address '%s'", s)
+		}
+
+		bits := 8 * net.IPv4len
+		if ip.To4() == nil {
+			bits = 8 * net.IPv6len
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(s)
+
+	return network, err
+}
+//
+//
+func parseExpiry(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+//
+//
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+//
+//
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHashedKey(t *testing.T) {
+	pepper := []byte("pepper")
+
+	plain, hashed, err := generateAPIKey(pepper)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(hashed, plain) {
+		t.Fatal("the hashed line contains the key")
+	}
+
+	key, err := newAPIKey("k", hashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !key.matches(plain, pepper) {
+		t.Error("key doesn't match")
+	}
+
+	if key.matches(plain, nil) || key.matches(plain + "x", pepper) {
+		t.Error("key matches with the wrong pepper or value")
+	}
+
+	for _, bad := range []string{"sha256:zz:00", "sha256:00:0011", "sha256:00"} {
+		if _, err := newAPIKey("k", bad); err == nil {
+			t.Errorf("'%s' accepted", bad)
+		}
+	}
+}
+
+func TestLookupAPIKey(t *testing.T) {
+	config := NewConfig()
+	config.pepper = []byte("pepper")
+
+	plain, hashed, _ := generateAPIKey(config.pepper)
+
+	a, _ := newAPIKey("a", hashed)
+	b, _ := newAPIKey("b", "plain-key")
+	s, _ := newAPIKey("s", "signed-key")
+	s.hmac = newHmacConfig("secret")
+
+	config.apikeys = []*apiKey{a, b, s}
+
+	for candidate, want := range map[string]*apiKey{plain: a, "plain-key": b, "s": s, "b": nil, "a": nil, "": nil} {
+		if got := config.lookupAPIKey(candidate); got != want {
+			t.Errorf("'%s': got %v", candidate, got)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	network, _ := parseCIDR("192.168.1.0/24")
+
+	key := &apiKey{
+		name:		"k",
+		enabled:	true,
+		dataIds:	[]string{"home.*", "garage"},
+		methods:	[]string{"POST"},
+		networks:	[]*net.IPNet{network},
+	}
+
+	tests := []struct {
+		name			string
+		method			string
+		ip				string
+		dataId			string
+		ok				bool
+	}{
+		{"allowed",			"POST",	"192.168.1.10",	"home.door",	true},
+		{"exact dataId",	"POST",	"192.168.1.10",	"garage",		true},
+		{"dataId",			"POST",	"192.168.1.10",	"office",		false},
+		{"method",			"GET",	"192.168.1.10",	"garage",		false},
+		{"network",			"POST",	"10.0.0.1",		"garage",		false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/ifttt/" + tt.dataId, nil)
+
+		if err := key.authorize(r, net.ParseIP(tt.ip), tt.dataId); (err == nil) != tt.ok {
+			t.Errorf("%s: err = %v", tt.name, err)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/ifttt/garage", nil)
+	ip := net.ParseIP("192.168.1.10")
+
+	key.expires = time.Now().Add(-time.Minute)
+	if err := key.authorize(r, ip, "garage"); err != errKeyExpired {
+		t.Errorf("expired: err = %v", err)
+	}
+
+	key.expires = time.Now().Add(time.Minute)
+	key.enabled = false
+	if err := key.authorize(r, ip, "garage"); err != errKeyDisabled {
+		t.Errorf("disabled: err = %v", err)
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	for s, want := range map[string]string{
+		"10.0.0.0/8":	"10.0.0.0/8",
+		"10.1.2.3":		"10.1.2.3/32",
+		"fd00::1":		"fd00::1/128",
+	} {
+		network, err := parseCIDR(s)
+		if err != nil || network.String() != want {
+			t.Errorf("%s: %v, %v", s, network, err)
+		}
+	}
+
+	if _, err := parseCIDR("nope"); err == nil {
+		t.Error("expected an error for 'nope'")
+	}
+}
@@ -0,0 +1,227 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"net"
+	"net/http"
+)
+
+//
+// brute force protection: every invalid API key or signature counts as a failure for the client address, and
+// max_failures of them within failure_window gets the address banned for ban_duration. Failures only age out;
+// valid requests in between don't clear them, or a client holding any key could keep guessing for others.
+// Behind a reverse proxy the client address comes from X-Forwarded-For, but only when the request came through
+// one of the trusted_proxies
+//
+
+const (
+	banPruneInterval		time.Duration = time.Minute
+)
+
+type failureRecord struct {
+	count				int
+	first				time.Time			// of the failures in the current window
+	bannedUntil			time.Time
+}
+
+type banList struct {
+	mutex				sync.Mutex
+	records				map[string]*failureRecord
+	lastPrune			time.Time
+}
+
+//
+//
+func newBanList() *banList {
+	return &banList{records: make(map[string]*failureRecord), lastPrune: time.Now()}
+}
+//
+// true and the time left if ip is banned
+//
+func (bans *banList) banned(ip string) (bool, time.Duration) {
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+
+	if record, ok := bans.records[ip]; ok {
+		if left := time.Until(record.bannedUntil); left > 0 {
+			return true, left
+		}
+	}
+
+	return false, 0
+}
+//
+// counts a failure; true if that got ip banned
+//
+func (bans *banList) fail(ip string, config *DispatcherConfiguration) bool {
+	if config.maxFailures <= 0 {
+		return false
+	}
+
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+
+	now := time.Now()
+
+	if now.Sub(bans.lastPrune) > banPruneInterval {
+		bans.prune(now, config.failureWindow)
+	}
+
+	record, ok := bans.records[ip]
+	if !ok || now.Sub(record.first) > config.failureWindow {
+		record = &failureRecord{first: now}
+		bans.records[ip] = record
+	}
+
+	record.count++
+
+	if record.count < config.maxFailures {
+		return false
+	}
+
+	record.count		= 0
+	record.first		= now
+	record.bannedUntil	= now.Add(config.banDuration)
+
+	return true
+}
+//
+// called with the mutex held
+//
+func (bans *banList) prune(now time.Time, window time.Duration) {
+	for ip, record := range bans.records {
+		if now.After(record.bannedUntil) && now.Sub(record.first) > window {
+			delete(bans.records, ip)
+		}
+	}
+
+	bans.lastPrune = now
+}
+//
+// the addresses currently banned, with the seconds left
+//
+func (bans *banList) list() map[string]int64 {
+	bans.mutex.Lock()
+	defer bans.mutex.Unlock()
+
+	list := make(map[string]int64)
+
+	for ip, record := range bans.records {
+		if left := time.Until(record.bannedUntil); left > 0 {
+			list[ip] = int64(left.Seconds() + 0.5)
+		}
+	}
+
+	return list
+}
+
+/******************************************************************************************************************
+ * client address
+ *
+ */
+
+//
+// X-Forwarded-For is read right to left, skipping our own proxies; the first address that isn't one of them
+// is the client. Anything further left could have been made up by the client
+//
+func clientIP(config *DispatcherConfiguration, r *http.Request) net.IP {
+	ip := remoteIP(r)
+
+	if !isTrustedProxy(config, ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+
+		ip = hop
+
+		if !isTrustedProxy(config, ip) {
+			break
+		}
+	}
+
+	return ip
+}
+//
+// for logs and payloads: the connection's host:port, or just the client address when it was forwarded
+//
+func clientAddr(config *DispatcherConfiguration, r *http.Request) string {
+	if ip := clientIP(config, r); ip != nil && !ip.Equal(remoteIP(r)) {
+		return ip.String()
+	}
+
+	return r.RemoteAddr
+}
+//
+//
+func isTrustedProxy(config *DispatcherConfiguration, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range config.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/******************************************************************************************************************
+ * redaction
+ *
+ */
+
+//
+// enough of an attempted key to recognise it in the logs, not enough to use it
+//
+func redactKey(key string) string {
+	if len(key) < 12 {
+		return "*** (" + strconv.Itoa(len(key)) + " chars)"
+	}
+
+	return key[:2] + "***" + key[len(key) - 2:] + " (" + strconv.Itoa(len(key)) + " chars)"
+}
+//
+// /ifttt/<apikey>/<dataId> with the key redacted
+//
+func redactPath(path string) string {
+	f := strings.Split(path, "/")
+
+	if len(f) == 4 && f[2] != "" {
+		f[2] = redactKey(f[2])
+	}
+
+	return strings.Join(f, "/")
+}
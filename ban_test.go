@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	config := NewConfig()
+	config.maxFailures		= 3
+	config.failureWindow	= time.Minute
+	config.banDuration		= 50 * time.Millisecond
+
+	bans := newBanList()
+
+	for i := 1; i <= 3; i++ {
+		if banned := bans.fail("192.0.2.1", config); banned != (i == 3) {
+			t.Errorf("failure %d: banned = %t", i, banned)
+		}
+	}
+
+	if banned, left := bans.banned("192.0.2.1"); !banned || left <= 0 {
+		t.Error("not banned after 3 failures")
+	}
+
+	if banned, _ := bans.banned("192.0.2.2"); banned {
+		t.Error("other address banned")
+	}
+
+	if list := bans.list(); len(list) != 1 {
+		t.Errorf("list = %v", list)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if banned, _ := bans.banned("192.0.2.1"); banned {
+		t.Error("still banned after ban_duration")
+	}
+}
+
+func TestBanListWindow(t *testing.T) {
+	config := NewConfig()
+	config.maxFailures		= 2
+	config.failureWindow	= 20 * time.Millisecond
+
+	bans := newBanList()
+
+	bans.fail("192.0.2.1", config)
+	time.Sleep(30 * time.Millisecond)
+
+	if bans.fail("192.0.2.1", config) {
+		t.Error("banned for failures outside the window")
+	}
+
+	config.maxFailures = 0
+
+	for i := 0; i < 10; i++ {
+		if bans.fail("192.0.2.3", config) {
+			t.Fatal("banned with max_failures = 0")
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	config := NewConfig()
+
+	for _, cidr := range []string{"10.0.0.0/8", "fd00::/8"} {
+		network, _ := parseCIDR(cidr)
+		config.trustedProxies = append(config.trustedProxies, network)
+	}
+
+	tests := []struct {
+		remote			string
+		xff				string
+		want			string
+	}{
+		{"192.0.2.1:1000",	"198.51.100.1",						"192.0.2.1"},		// not a proxy, so ignored
+		{"10.0.0.1:1000",	"",									"10.0.0.1"},
+		{"10.0.0.1:1000",	"198.51.100.1",						"198.51.100.1"},
+		{"10.0.0.1:1000",	"1.2.3.4, 198.51.100.1, 10.0.0.2",	"198.51.100.1"},	// 1.2.3.4 could be made up
+		{"10.0.0.1:1000",	"garbage, 10.0.0.2",				"10.0.0.2"},
+		{"[fd00::1]:1000",	"2001:db8::1",						"2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remote
+		if tt.xff != "" {
+			r.Header.Set("X-Forwarded-For", tt.xff)
+		}
+
+		if got := clientIP(config, r); !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("%s, '%s': got %s, want %s", tt.remote, tt.xff, got, tt.want)
+		}
+	}
+}
+
+func TestRedactKey(t *testing.T) {
+	key := "0123456789abcdef"
+
+	if s := redactKey(key); strings.Contains(s, "456789") || !strings.Contains(s, "16 chars") {
+		t.Errorf("redactKey() = %s", s)
+	}
+
+	if s := redactKey("short"); strings.Contains(s, "short") {
+		t.Errorf("redactKey() = %s", s)
+	}
+
+	if s := redactPath("/ifttt/" + key + "/x"); strings.Contains(s, key) || !strings.HasSuffix(s, "/x") {
+		t.Errorf("redactPath() = %s", s)
+	}
+
+	if s := redactPath("/ifttt/x"); s != "/ifttt/x" {
+		t.Errorf("redactPath() = %s", s)
+	}
+}
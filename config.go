@@ -22,6 +22,12 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"text/template"
 	"github.com/go-ini/ini"
 	"github.com/mikejac/log.golang"
 )
@@ -33,7 +39,28 @@ func NewConfig() (config *DispatcherConfiguration) {
     config.MqttOptions	    = NewMqttOptions()
     config.httpIp 			= ""
     config.httpPort 		= "8080"
+    config.maxBodySize      = 64 * 1024
+    config.waitForPublish   = true
+    config.publishWait      = 5 * time.Second
+    config.keySources       = []string{keySourcePath, keySourceBearer, keySourceHeader}
+    config.keyHeader        = "X-API-Key"
+    config.keyParam         = "key"
+    config.maxFailures      = 10
+    config.failureWindow    = 10 * time.Minute
+    config.banDuration      = 15 * time.Minute
     config.useTLS           = false
+    config.outboxMaxEntries = 1000
+    config.outboxMaxAge     = 24 * time.Hour
+    config.outboxDropPolicy = outboxDropOldest
+    config.payloadMode      = payloadModeLocation
+    config.haPrefix         = haDefaultPrefix
+    config.iftttUrl         = iftttDefaultUrl
+    config.iftttRate        = 30
+    config.iftttBurst       = 5
+    config.iftttRetries     = 3
+    config.iftttTimeout     = 10 * time.Second
+    config.dataIds          = make(map[string]*DataIdConfiguration)
+    config.schemas          = make(map[string]*PayloadSchema)
     
     return config
 }
@@ -41,16 +68,35 @@ func NewConfig() (config *DispatcherConfiguration) {
 //
 //
 func (config *DispatcherConfiguration) ReadConfig(configfile string) (err error) {
-	cfg, err := ini.Load(configfile)
+	// a comment needs a space in front, or the '#' of a topic filter would start one
+	cfg, err := ini.LoadSources(ini.LoadOptions{SpaceBeforeInlineComment: true}, configfile)
 	if err != nil {
     	log.Infof("error: %s\n", err.Error())
 		return err
 	}
+
+    config.configFile = configfile
     
 	/******************************************************************************************************************
 	 * MQTT settings
 	 *
 	 */    
+    if cfg.Section("mqtt").HasKey("url") {
+        config.MqttOptions.SetUrl(cfg.Section("mqtt").Key("url").String())
+    }
+
+    // comma separated, in order of preference
+    if cfg.Section("mqtt").HasKey("brokers") {
+        for _, broker := range cfg.Section("mqtt").Key("brokers").Strings(",") {
+            config.MqttOptions.AddBroker(broker)
+        }
+    }
+
+    // headers for the WebSocket upgrade, one key per header
+    for _, key := range cfg.Section("mqtt.headers").Keys() {
+        config.MqttOptions.SetHTTPHeader(key.Name(), key.String())
+    }
+
     if cfg.Section("mqtt").HasKey("clientid") {
         config.MqttOptions.SetClientId(cfg.Section("mqtt").Key("clientid").String())
     }
@@ -64,11 +110,97 @@ func (config *DispatcherConfiguration) ReadConfig(configfile string) (err error)
         config.MqttOptions.SetPort(port)
     }
 
+    if cfg.Section("mqtt").HasKey("protocol") {
+        switch protocol := cfg.Section("mqtt").Key("protocol").String(); protocol {
+        case "3.1.1", "4":
+            config.MqttOptions.SetProtocolVersion(MqttProtocol311)
+        case "5":
+            config.MqttOptions.SetProtocolVersion(MqttProtocol5)
+        default:
+            return fmt.Errorf("[mqtt] unsupported protocol '%s'", protocol)
+        }
+    }
+
+    if cfg.Section("mqtt").HasKey("content_type") {
+        config.MqttOptions.SetContentType(cfg.Section("mqtt").Key("content_type").String())
+    }
+
+    if cfg.Section("mqtt").HasKey("message_expiry") {
+        expiry, _ := cfg.Section("mqtt").Key("message_expiry").Uint()
+        config.MqttOptions.SetMessageExpiry(uint32(expiry))
+    }
+
+    if cfg.Section("mqtt").HasKey("response_topic") {
+        config.MqttOptions.SetResponseTopic(cfg.Section("mqtt").Key("response_topic").String())
+    }
+
     if cfg.Section("mqtt").HasKey("keepalive") {
         keepalive, _ := cfg.Section("mqtt").Key("keepalive").Int()
         config.MqttOptions.SetKeepalive(keepalive)
     }
 
+    if cfg.Section("mqtt").HasKey("publish_timeout") {
+        timeout, _ := cfg.Section("mqtt").Key("publish_timeout").Int()
+        config.MqttOptions.SetPublishTimeout(timeout)
+    }
+
+    if cfg.Section("mqtt").HasKey("qos") {
+        qos, err := parseQos(cfg.Section("mqtt").Key("qos").String())
+        if err != nil {
+            return fmt.Errorf("[mqtt] %s", err.Error())
+        }
+        config.MqttOptions.SetQos(qos)
+    }
+
+    if cfg.Section("mqtt").HasKey("topic") {
+        if config.topicTemplate, err = parseTemplate("mqtt", cfg.Section("mqtt").Key("topic").String()); err != nil {
+            return fmt.Errorf("[mqtt] invalid topic; %s", err.Error())
+        }
+    }
+
+    if cfg.Section("mqtt").HasKey("retain") {
+        retain, _ := cfg.Section("mqtt").Key("retain").Bool()
+        config.MqttOptions.SetRetain(retain)
+    }
+
+    if cfg.Section("mqtt").HasKey("use_tls") {
+        useTLS, _ := cfg.Section("mqtt").Key("use_tls").Bool()
+        config.MqttOptions.SetUseTLS(useTLS)
+    }
+
+    if cfg.Section("mqtt").HasKey("ca_file") {
+        config.MqttOptions.SetCaFile(cfg.Section("mqtt").Key("ca_file").String())
+    }
+
+    if cfg.Section("mqtt").HasKey("cert_file") || cfg.Section("mqtt").HasKey("key_file") {
+        config.MqttOptions.SetClientCertificate(cfg.Section("mqtt").Key("cert_file").String(), cfg.Section("mqtt").Key("key_file").String())
+    }
+
+    if cfg.Section("mqtt").HasKey("server_name") {
+        config.MqttOptions.SetServerName(cfg.Section("mqtt").Key("server_name").String())
+    }
+
+    if cfg.Section("mqtt").HasKey("insecure_skip_verify") {
+        insecure, _ := cfg.Section("mqtt").Key("insecure_skip_verify").Bool()
+        config.MqttOptions.SetInsecureSkipVerify(insecure)
+    }
+
+    if cfg.Section("mqtt").HasKey("username") {
+        config.MqttOptions.SetUsername(cfg.Section("mqtt").Key("username").String())
+    }
+
+    if cfg.Section("mqtt").HasKey("password") {
+        config.MqttOptions.SetPassword(cfg.Section("mqtt").Key("password").String())
+    }
+
+    if cfg.Section("mqtt").HasKey("password_file") {
+        config.MqttOptions.SetPasswordFile(cfg.Section("mqtt").Key("password_file").String())
+    }
+
+    if cfg.Section("mqtt").HasKey("password_env") {
+        config.MqttOptions.SetPasswordEnv(cfg.Section("mqtt").Key("password_env").String())
+    }
+
 	/******************************************************************************************************************
 	 * MsgBus settings
 	 *
@@ -86,6 +218,11 @@ func (config *DispatcherConfiguration) ReadConfig(configfile string) (err error)
         config.MqttOptions.SetStatusInterval(interval)
     }
 
+    if cfg.Section("msgbus").HasKey("stale_after") {
+        intervals, _ := cfg.Section("msgbus").Key("stale_after").Int()
+        config.MqttOptions.SetStaleAfter(intervals)
+    }
+
 	/******************************************************************************************************************
 	 * HTTP settings
 	 *
@@ -98,6 +235,51 @@ func (config *DispatcherConfiguration) ReadConfig(configfile string) (err error)
         config.httpPort = cfg.Section("http").Key("port").String()
     }
 
+    if cfg.Section("http").HasKey("max_body_size") {
+        size, _ := cfg.Section("http").Key("max_body_size").Int64()
+        config.maxBodySize = size
+    }
+
+    if cfg.Section("http").HasKey("wait_for_publish") {
+        wait, _ := cfg.Section("http").Key("wait_for_publish").Bool()
+        config.waitForPublish = wait
+    }
+
+    if cfg.Section("http").HasKey("publish_wait") {
+        seconds, _ := cfg.Section("http").Key("publish_wait").Int()
+        config.publishWait = time.Duration(seconds) * time.Second
+    }
+
+    // the query string is left out by default since it ends up in access logs
+    if cfg.Section("http").HasKey("key_sources") {
+        config.keySources = cfg.Section("http").Key("key_sources").Strings(",")
+
+        for _, source := range config.keySources {
+            if !isValidKeySource(source) {
+                return fmt.Errorf("[http] unknown key source '%s'", source)
+            }
+        }
+    }
+
+    if cfg.Section("http").HasKey("key_header") {
+        config.keyHeader = cfg.Section("http").Key("key_header").String()
+    }
+
+    if cfg.Section("http").HasKey("key_param") {
+        config.keyParam = cfg.Section("http").Key("key_param").String()
+    }
+
+    if cfg.Section("http").HasKey("trusted_proxies") {
+        for _, cidr := range cfg.Section("http").Key("trusted_proxies").Strings(",") {
+            network, err := parseCIDR(cidr)
+            if err != nil {
+                return fmt.Errorf("[http] trusted_proxies; %s", err.Error())
+            }
+
+            config.trustedProxies = append(config.trustedProxies, network)
+        }
+    }
+
     if cfg.Section("http").HasKey("use_tls") {
         useTLS, _ := cfg.Section("http").Key("use_tls").Bool()
         config.useTLS = useTLS
@@ -121,13 +303,588 @@ func (config *DispatcherConfiguration) ReadConfig(configfile string) (err error)
 	 * API Keys
 	 *
      */
+    if cfg.Section("security").HasKey("pepper") {
+        config.pepper = []byte(cfg.Section("security").Key("pepper").String())
+    }
+
+    if cfg.Section("security").HasKey("pepper_env") {
+        name := cfg.Section("security").Key("pepper_env").String()
+
+        // an empty pepper would quietly make every hashed key fail to match
+        pepper := os.Getenv(name)
+        if pepper == "" {
+            return fmt.Errorf("[security] pepper_env; '%s' is not set", name)
+        }
+
+        config.pepper = []byte(pepper)
+    }
+
+    if cfg.Section("security").HasKey("max_failures") {
+        config.maxFailures, _ = cfg.Section("security").Key("max_failures").Int()
+    }
+
+    if cfg.Section("security").HasKey("failure_window") {
+        seconds, _ := cfg.Section("security").Key("failure_window").Int()
+        config.failureWindow = time.Duration(seconds) * time.Second
+    }
+
+    if cfg.Section("security").HasKey("ban_duration") {
+        seconds, _ := cfg.Section("security").Key("ban_duration").Int()
+        config.banDuration = time.Duration(seconds) * time.Second
+    }
+
     names := cfg.Section("apikeys").KeyStrings()
     
     for _, n := range names {
-        apikey := cfg.Section("apikeys").Key(n).String()
+        key, err := newAPIKey(n, cfg.Section("apikeys").Key(n).String())
+        if err != nil {
+            return fmt.Errorf("[apikeys] %s; %s", n, err.Error())
+        }
         
-        config.apikeys = append(config.apikeys, apikey)
+        config.apikeys = append(config.apikeys, key)
+    }
+
+    for _, key := range config.apikeys {
+        section, err := cfg.GetSection("apikey." + key.name)
+        if err != nil {
+            continue
+        }
+
+        if section.HasKey("enabled") {
+            key.enabled, _ = section.Key("enabled").Bool()
+        }
+
+        if section.HasKey("expires") {
+            if key.expires, err = parseExpiry(section.Key("expires").String()); err != nil {
+                return fmt.Errorf("[%s] invalid expires '%s'", section.Name(), section.Key("expires").String())
+            }
+        }
+
+        if section.HasKey("dataids") {
+            key.dataIds = section.Key("dataids").Strings(",")
+        }
+
+        if section.HasKey("methods") {
+            for _, method := range section.Key("methods").Strings(",") {
+                key.methods = append(key.methods, strings.ToUpper(method))
+            }
+        }
+
+        if section.HasKey("cidrs") {
+            for _, cidr := range section.Key("cidrs").Strings(",") {
+                network, err := parseCIDR(cidr)
+                if err != nil {
+                    return fmt.Errorf("[%s] %s", section.Name(), err.Error())
+                }
+
+                key.networks = append(key.networks, network)
+            }
+        }
+    }
+
+    for _, key := range config.apikeys {
+        section, err := cfg.GetSection("hmac." + key.name)
+        if err != nil {
+            continue
+        }
+
+        // the API key itself is the secret, unless there's a separate one
+        if key.hash != nil && !section.HasKey("secret") {
+            return fmt.Errorf("[%s] a hashed API key can't be the secret, set one", section.Name())
+        }
+
+        key.hmac = newHmacConfig(section.Key("secret").MustString(key.key))
+
+        if section.HasKey("header") {
+            key.hmac.header = section.Key("header").String()
+        }
+
+        if section.HasKey("timestamp_header") {
+            key.hmac.timestampHeader = section.Key("timestamp_header").String()
+        }
+
+        if section.HasKey("prefix") {
+            key.hmac.prefix = section.Key("prefix").String()
+        }
+
+        if section.HasKey("window") {
+            seconds, _ := section.Key("window").Int()
+            key.hmac.window = time.Duration(seconds) * time.Second
+        }
+    }
+
+    for _, section := range cfg.Sections() {
+        for _, prefix := range []string{"apikey.", "hmac."} {
+            if name := strings.TrimPrefix(section.Name(), prefix); name != section.Name() && config.apiKeyByName(name) == nil {
+                return fmt.Errorf("[%s] no such API key in [apikeys]", section.Name())
+            }
+        }
+    }
+
+	/******************************************************************************************************************
+	 * Rate limits, in requests per minute
+	 *
+     */
+    if cfg.Section("ratelimit").HasKey("ip_rate") {
+        config.ipLimit.rate, _ = cfg.Section("ratelimit").Key("ip_rate").Float64()
+    }
+
+    if cfg.Section("ratelimit").HasKey("ip_burst") {
+        config.ipLimit.burst, _ = cfg.Section("ratelimit").Key("ip_burst").Int()
+    }
+
+    if cfg.Section("ratelimit").HasKey("key_rate") {
+        config.keyLimit.rate, _ = cfg.Section("ratelimit").Key("key_rate").Float64()
+    }
+
+    if cfg.Section("ratelimit").HasKey("key_burst") {
+        config.keyLimit.burst, _ = cfg.Section("ratelimit").Key("key_burst").Int()
+    }
+
+    if cfg.Section("ratelimit").HasKey("dataid_rate") {
+        config.dataIdLimit.rate, _ = cfg.Section("ratelimit").Key("dataid_rate").Float64()
+    }
+
+    if cfg.Section("ratelimit").HasKey("dataid_burst") {
+        config.dataIdLimit.burst, _ = cfg.Section("ratelimit").Key("dataid_burst").Int()
+    }
+
+    for _, key := range config.apikeys {
+        if section, err := cfg.GetSection("apikey." + key.name); err == nil {
+            key.limit = sectionRateLimit(section, config.keyLimit)
+        }
+    }
+
+	/******************************************************************************************************************
+	 * Outbox settings
+	 *
+     */
+    if cfg.Section("outbox").HasKey("path") {
+        config.outboxPath = cfg.Section("outbox").Key("path").String()
+    }
+
+    if cfg.Section("outbox").HasKey("max_entries") {
+        maxEntries, _ := cfg.Section("outbox").Key("max_entries").Int()
+        config.outboxMaxEntries = maxEntries
+    }
+
+    if cfg.Section("outbox").HasKey("max_age") {
+        seconds, _ := cfg.Section("outbox").Key("max_age").Int()
+        config.outboxMaxAge = time.Duration(seconds) * time.Second
+    }
+
+    if cfg.Section("outbox").HasKey("drop_policy") {
+        config.outboxDropPolicy = cfg.Section("outbox").Key("drop_policy").String()
+    }
+
+	/******************************************************************************************************************
+	 * Payload settings
+	 *
+     */
+    if cfg.Section("payload").HasKey("mode") {
+        config.payloadMode = cfg.Section("payload").Key("mode").String()
+
+        if !isValidPayloadMode(config.payloadMode) {
+            return fmt.Errorf("[payload] unknown mode '%s'", config.payloadMode)
+        }
+    }
+
+	/******************************************************************************************************************
+	 * Forwarding rules
+	 *
+     */
+    for _, section := range cfg.Sections() {
+        if !strings.HasPrefix(section.Name(), "forward.") || strings.HasSuffix(section.Name(), ".headers") {
+            continue
+        }
+
+        rule := &forwardRule{
+            name:           strings.TrimPrefix(section.Name(), "forward."),
+            topic:          section.Key("topic").String(),
+            method:         strings.ToUpper(section.Key("method").MustString(http.MethodPost)),
+            header:         make(http.Header),
+            username:       section.Key("username").String(),
+            password:       section.Key("password").String(),
+            bearerToken:    section.Key("bearer_token").String(),
+            retries:        section.Key("retries").MustInt(config.iftttRetries),
+            timeout:        time.Duration(section.Key("timeout").MustInt(int(config.iftttTimeout / time.Second))) * time.Second,
+            deadLetter:     section.Key("dead_letter").String(),
+        }
+
+        if rule.topic == "" {
+            return fmt.Errorf("[%s] missing topic", section.Name())
+        }
+
+        // a failing endpoint would get its own dead letters, over and over
+        if rule.deadLetter != "" && topicMatches(rule.topic, rule.deadLetter) {
+            return fmt.Errorf("[%s] dead_letter '%s' matches the rule's own topic", section.Name(), rule.deadLetter)
+        }
+
+        if !section.HasKey("url") {
+            return fmt.Errorf("[%s] missing url", section.Name())
+        }
+
+        if rule.url, err = parseTemplate("url", section.Key("url").String()); err != nil {
+            return fmt.Errorf("[%s] invalid url; %s", section.Name(), err.Error())
+        }
+
+        if section.HasKey("body") {
+            if rule.body, err = parseTemplate("body", section.Key("body").String()); err != nil {
+                return fmt.Errorf("[%s] invalid body; %s", section.Name(), err.Error())
+            }
+        }
+
+        rule.header.Set("Content-Type", section.Key("content_type").MustString(contentTypeJSON))
+
+        for _, key := range cfg.Section(section.Name() + ".headers").Keys() {
+            rule.header.Set(key.Name(), key.String())
+        }
+
+        config.forwards = append(config.forwards, rule)
+    }
+
+	/******************************************************************************************************************
+	 * Home Assistant discovery
+	 *
+     */
+    if cfg.Section("homeassistant").HasKey("discovery") {
+        discovery, _ := cfg.Section("homeassistant").Key("discovery").Bool()
+        config.haDiscovery = discovery
+    }
+
+    if cfg.Section("homeassistant").HasKey("prefix") {
+        config.haPrefix = cfg.Section("homeassistant").Key("prefix").String()
+    }
+
+	/******************************************************************************************************************
+	 * IFTTT Maker triggers
+	 *
+     */
+    if cfg.Section("ifttt").HasKey("url") {
+        config.iftttUrl = cfg.Section("ifttt").Key("url").String()
+    }
+
+    if cfg.Section("ifttt").HasKey("key") {
+        config.iftttKey = cfg.Section("ifttt").Key("key").String()
+    }
+
+    if cfg.Section("ifttt").HasKey("rate") {
+        rate, _ := cfg.Section("ifttt").Key("rate").Int()
+        config.iftttRate = rate
+    }
+
+    if cfg.Section("ifttt").HasKey("burst") {
+        burst, _ := cfg.Section("ifttt").Key("burst").Int()
+        config.iftttBurst = burst
+    }
+
+    if cfg.Section("ifttt").HasKey("retries") {
+        retries, _ := cfg.Section("ifttt").Key("retries").Int()
+        config.iftttRetries = retries
+    }
+
+    if cfg.Section("ifttt").HasKey("timeout") {
+        seconds, _ := cfg.Section("ifttt").Key("timeout").Int()
+        config.iftttTimeout = time.Duration(seconds) * time.Second
+    }
+
+    if cfg.Section("ifttt").HasKey("dead_letter") {
+        config.iftttDeadLetter = cfg.Section("ifttt").Key("dead_letter").String()
+    }
+
+    for _, section := range cfg.Sections() {
+        if !strings.HasPrefix(section.Name(), "trigger.") {
+            continue
+        }
+
+        trigger := &iftttTrigger{
+            name:   strings.TrimPrefix(section.Name(), "trigger."),
+            topic:  section.Key("topic").String(),
+            event:  section.Key("event").String(),
+            key:    section.Key("key").String(),
+        }
+
+        if trigger.topic == "" {
+            return fmt.Errorf("[%s] missing topic", section.Name())
+        }
+
+        if config.iftttDeadLetter != "" && topicMatches(trigger.topic, config.iftttDeadLetter) {
+            return fmt.Errorf("[%s] topic matches the [ifttt] dead_letter '%s'", section.Name(), config.iftttDeadLetter)
+        }
+
+        if trigger.event == "" {
+            trigger.event = trigger.name
+        }
+
+        if trigger.key == "" && config.iftttKey == "" {
+            return fmt.Errorf("[%s] no key here nor in [ifttt]", section.Name())
+        }
+
+        for i := range trigger.values {
+            name := fmt.Sprintf("value%d", i + 1)
+
+            if section.HasKey(name) {
+                if trigger.values[i], err = parseTemplate(name, section.Key(name).String()); err != nil {
+                    return fmt.Errorf("[%s] invalid %s; %s", section.Name(), name, err.Error())
+                }
+            }
+        }
+
+        config.triggers = append(config.triggers, trigger)
+    }
+
+	/******************************************************************************************************************
+	 * Payload schemas; these must be known before the data IDs refer to them
+	 *
+     */
+    for _, section := range cfg.Sections() {
+        if !strings.HasPrefix(section.Name(), "schema.") {
+            continue
+        }
+
+        schema, err := newPayloadSchema(section)
+        if err != nil {
+            return err
+        }
+
+        config.schemas[schema.name] = schema
+    }
+
+	/******************************************************************************************************************
+	 * Data ID settings
+	 *
+     */
+    for _, section := range cfg.Sections() {
+        if !strings.HasPrefix(section.Name(), "dataid.") {
+            continue
+        }
+
+        dataId := strings.TrimPrefix(section.Name(), "dataid.")
+        d      := &DataIdConfiguration{}
+
+        if section.HasKey("mode") {
+            d.payloadMode = section.Key("mode").String()
+
+            if !isValidPayloadMode(d.payloadMode) {
+                return fmt.Errorf("[%s] unknown mode '%s'", section.Name(), d.payloadMode)
+            }
+        }
+
+        if section.HasKey("schema") {
+            name := section.Key("schema").String()
+
+            if d.schema = config.schemas[name]; d.schema == nil {
+                return fmt.Errorf("[%s] unknown schema '%s'", section.Name(), name)
+            }
+        }
+
+        if section.HasKey("topic") {
+            if d.topicTemplate, err = parseTemplate(section.Name(), section.Key("topic").String()); err != nil {
+                return fmt.Errorf("[%s] invalid topic; %s", section.Name(), err.Error())
+            }
+        }
+
+        if section.HasKey("qos") {
+            qos, err := parseQos(section.Key("qos").String())
+            if err != nil {
+                return fmt.Errorf("[%s] %s", section.Name(), err.Error())
+            }
+            d.qos = &qos
+        }
+
+        if section.HasKey("retain") {
+            retain, err := section.Key("retain").Bool()
+            if err != nil {
+                return fmt.Errorf("[%s] invalid retain '%s'", section.Name(), section.Key("retain").String())
+            }
+            d.retain = &retain
+        }
+
+        d.limit = sectionRateLimit(section, config.dataIdLimit)
+
+        if section.HasKey("ha_component") {
+            d.haComponent = section.Key("ha_component").String()
+
+            if !isValidHaComponent(d.haComponent) {
+                return fmt.Errorf("[%s] unknown ha_component '%s'", section.Name(), d.haComponent)
+            }
+        }
+
+        if section.HasKey("ha_name") {
+            d.haName = section.Key("ha_name").String()
+        }
+
+        if section.HasKey("ha_value_template") {
+            d.haValueTemplate = section.Key("ha_value_template").String()
+        }
+
+        config.dataIds[dataId] = d
     }
  
     return nil
 }
+//
+// the settings that can be changed without a restart; the MQTT connection, the HTTP listener and the outbox
+// stay as they are
+//
+func (config *DispatcherConfiguration) copyRuntimeSettings(from *DispatcherConfiguration) {
+    config.maxBodySize      = from.maxBodySize
+    config.waitForPublish   = from.waitForPublish
+    config.publishWait      = from.publishWait
+    config.keySources       = from.keySources
+    config.ipLimit          = from.ipLimit
+    config.keyLimit         = from.keyLimit
+    config.dataIdLimit      = from.dataIdLimit
+    config.keyHeader        = from.keyHeader
+    config.keyParam         = from.keyParam
+    config.trustedProxies   = from.trustedProxies
+
+    // signatures seen before the reload mustn't become valid again
+    for _, key := range from.apikeys {
+        if old := config.apiKeyByName(key.name); old != nil && old.hmac != nil && key.hmac != nil {
+            key.hmac.replays = old.hmac.replays
+        }
+    }
+
+    config.apikeys          = from.apikeys
+    config.pepper           = from.pepper
+    config.maxFailures      = from.maxFailures
+    config.failureWindow    = from.failureWindow
+    config.banDuration      = from.banDuration
+    config.payloadMode      = from.payloadMode
+    config.topicTemplate    = from.topicTemplate
+    config.dataIds          = from.dataIds
+    config.schemas          = from.schemas
+}
+//
+//
+func (config *DispatcherConfiguration) lookupAPIKey(apikey string) *apiKey {
+    var found *apiKey
+
+    // always go through all of them, so the time taken doesn't tell which key was close
+    for _, key := range config.apikeys {
+        if key.matches(apikey, config.pepper) && found == nil {
+            found = key
+        }
+    }
+
+    if found != nil {
+        return found
+    }
+
+    // keys that sign their requests can be given by name instead
+    if key := config.apiKeyByName(apikey); key != nil && key.hmac != nil {
+        return key
+    }
+
+    return nil
+}
+//
+//
+func (config *DispatcherConfiguration) apiKeyByName(name string) *apiKey {
+    for _, key := range config.apikeys {
+        if key.name == name {
+            return key
+        }
+    }
+
+    return nil
+}
+//
+//
+func (config *DispatcherConfiguration) dataIdPayloadMode(dataId string) string {
+    if d, ok := config.dataIds[dataId]; ok && d.payloadMode != "" {
+        return d.payloadMode
+    }
+
+    return config.payloadMode
+}
+//
+//
+func (config *DispatcherConfiguration) dataIdSchema(dataId string) *PayloadSchema {
+    if d, ok := config.dataIds[dataId]; ok {
+        return d.schema
+    }
+
+    return nil
+}
+//
+// nil means the msgbus layout
+//
+func (config *DispatcherConfiguration) dataIdTopicTemplate(dataId string) *template.Template {
+    if d, ok := config.dataIds[dataId]; ok && d.topicTemplate != nil {
+        return d.topicTemplate
+    }
+
+    return config.topicTemplate
+}
+//
+//
+func (config *DispatcherConfiguration) dataIdQos(dataId string) byte {
+    if d, ok := config.dataIds[dataId]; ok && d.qos != nil {
+        return *d.qos
+    }
+
+    return config.MqttOptions.Qos
+}
+//
+//
+func (config *DispatcherConfiguration) dataIdRetain(dataId string) bool {
+    if d, ok := config.dataIds[dataId]; ok && d.retain != nil {
+        return *d.retain
+    }
+
+    return config.MqttOptions.Retain
+}
+//
+//
+func (config *DispatcherConfiguration) keyRateLimit(key *apiKey) rateLimit {
+    if key.limit != nil {
+        return *key.limit
+    }
+
+    return config.keyLimit
+}
+//
+//
+func (config *DispatcherConfiguration) dataIdRateLimit(dataId string) rateLimit {
+    if d, ok := config.dataIds[dataId]; ok && d.limit != nil {
+        return *d.limit
+    }
+
+    return config.dataIdLimit
+}
+//
+// 'rate' and 'burst' in an [apikey.<name>] or [dataid.<name>] section; nil if neither is there
+//
+func sectionRateLimit(section *ini.Section, def rateLimit) *rateLimit {
+    if !section.HasKey("rate") && !section.HasKey("burst") {
+        return nil
+    }
+
+    limit := def
+
+    if section.HasKey("rate") {
+        limit.rate, _ = section.Key("rate").Float64()
+    }
+
+    if section.HasKey("burst") {
+        limit.burst, _ = section.Key("burst").Int()
+    }
+
+    return &limit
+}
+//
+//
+func parseQos(s string) (byte, error) {
+    switch s {
+    case "0":
+        return 0, nil
+    case "1":
+        return 1, nil
+    case "2":
+        return 2, nil
+    }
+
+    return 0, fmt.Errorf("invalid qos '%s'; must be 0, 1 or 2", s)
+}
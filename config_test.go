@@ -0,0 +1,99 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//
+//
+func writeConfig(t *testing.T, text string) string {
+	file := filepath.Join(t.TempDir(), "test.ini")
+
+	if err := ioutil.WriteFile(file, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func TestPepperEnv(t *testing.T) {
+	file := writeConfig(t, "[security]\npepper_env = IFTTT_TEST_PEPPER\n")
+
+	os.Unsetenv("IFTTT_TEST_PEPPER")
+
+	if err := NewConfig().ReadConfig(file); err == nil {
+		t.Error("unset pepper_env accepted")
+	}
+
+	t.Setenv("IFTTT_TEST_PEPPER", "")
+
+	if err := NewConfig().ReadConfig(file); err == nil {
+		t.Error("empty pepper_env accepted")
+	}
+
+	t.Setenv("IFTTT_TEST_PEPPER", "pepper")
+
+	config := NewConfig()
+	if err := config.ReadConfig(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(config.pepper) != "pepper" {
+		t.Errorf("pepper = '%s'", config.pepper)
+	}
+}
+
+func TestDeadLetterLoop(t *testing.T) {
+	tests := []struct {
+		text			string
+		ok				bool
+	}{
+		{"[forward.a]\ntopic = sensors/#\nurl = http://localhost/\ndead_letter = sensors/dead\n",		false},
+		{"[forward.a]\ntopic = sensors/+\nurl = http://localhost/\ndead_letter = sensors/dead\n",		false},
+		{"[forward.a]\ntopic = sensors/#\nurl = http://localhost/\ndead_letter = dead/sensors\n",		true},
+		{"[ifttt]\nkey = k\ndead_letter = home/dead\n[trigger.a]\ntopic = home/# ; everything at home\n",					false},
+		{"[ifttt]\nkey = k\ndead_letter = dead/home\n[trigger.a]\ntopic = home/# ; everything at home\n",					true},
+	}
+
+	for _, tt := range tests {
+		if err := NewConfig().ReadConfig(writeConfig(t, tt.text)); (err == nil) != tt.ok {
+			t.Errorf("%q: err = %v", tt.text, err)
+		}
+	}
+}
+
+func TestWildcardTopic(t *testing.T) {
+	config := NewConfig()
+
+	if err := config.ReadConfig(writeConfig(t, "[ifttt]\nkey = k ; comment\n[trigger.a]\ntopic = home/#\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.triggers) != 1 || config.triggers[0].topic != "home/#" || config.iftttKey != "k" {
+		t.Errorf("topic = '%s', key = '%s'", config.triggers[0].topic, config.iftttKey)
+	}
+}
@@ -22,32 +22,116 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"text/template"
+	"encoding/json"
 	"github.com/mikejac/log.golang"
 )
 
 type DispatcherConfiguration struct {
 	MqttOptions			*MqttOptions
+
+	configFile			string					// where the settings were read from, for reloading
 	
 	httpIp				string
 	httpPort			string
+	maxBodySize			int64
+	waitForPublish		bool					// respond only once the publish has been acknowledged
+	publishWait			time.Duration			// how long the HTTP handler waits for that
+	ipLimit				rateLimit				// per client address
+	keyLimit			rateLimit				// per API key, unless [apikey.<name>] has its own
+	dataIdLimit			rateLimit				// per data ID, unless [dataid.<name>] has its own
+	keySources			[]string				// where to look for the API key, in order; see apiKeyFromRequest()
+	keyHeader			string
+	keyParam			string
+	trustedProxies		[]*net.IPNet			// X-Forwarded-For is only believed when the connection comes from one of these
 	
 	useTLS				bool
 	certFile			string
 	keyFile				string
 
-	apikeys				[]string
+	apikeys				[]*apiKey
+	pepper				[]byte					// for hashed API keys, from [security]
+	maxFailures			int						// invalid keys or signatures before a client is banned; 0 to never ban
+	failureWindow		time.Duration			// ... counted over this long
+	banDuration			time.Duration
+
+	outboxPath			string					// no outbox unless set
+	outboxMaxEntries	int
+	outboxMaxAge		time.Duration
+	outboxDropPolicy	string
+
+	payloadMode			string							// default payload mode for data IDs without their own setting
+	topicTemplate		*template.Template				// default topic; nil for the msgbus layout
+
+	haDiscovery			bool							// publish Home Assistant discovery config for the data IDs
+	haPrefix			string
+
+	iftttUrl			string							// Maker webhooks service, for testing against a stand-in
+	iftttKey			string							// default Maker key for the triggers
+	iftttRate			int								// triggers per minute
+	iftttBurst			int
+	iftttRetries		int
+	iftttTimeout		time.Duration
+	iftttDeadLetter		string							// topic for triggers that couldn't be delivered
+	triggers			[]*iftttTrigger					// from the [trigger.<name>] sections
+	forwards			[]*forwardRule					// from the [forward.<name>] sections
+	dataIds				map[string]*DataIdConfiguration	// per data ID settings, from the [dataid.<name>] sections
+	schemas				map[string]*PayloadSchema		// from the [schema.<name>] sections
+}
+
+type apiKey struct {
+	name				string					// the key's name in the [apikeys] section
+	key					string					// plaintext; empty if hashed
+	salt				[]byte
+	hash				[]byte					// nil if plaintext
+	hmac				*hmacConfig				// requests must be signed if set
+
+	// permissions, from [apikey.<name>]; see apikey.go
+	enabled				bool
+	expires				time.Time				// zero for never
+	dataIds				[]string				// patterns; empty for any
+	methods				[]string				// empty for any
+	networks			[]*net.IPNet			// empty for any
+	limit				*rateLimit				// nil to use the [ratelimit] default
+}
+
+type DataIdConfiguration struct {
+	payloadMode			string
+	schema				*PayloadSchema
+	topicTemplate		*template.Template		// nil to use the [mqtt] default
+	qos					*byte					// nil to use the [mqtt] default
+	retain				*bool					// nil to use the [mqtt] default
+
+	limit				*rateLimit				// nil to use the [ratelimit] default
+
+	haComponent			string					// Home Assistant component; empty to pick one from the payload mode
+	haName				string
+	haValueTemplate		string
 }
 
 type Dispatcher struct {
-    config 				*DispatcherConfiguration
+    configMutex			sync.RWMutex
+    config 				*DispatcherConfiguration	// replaced, never modified, when settings change; use Config()
     mqtt				*Mqtt
+    outbox				*Outbox
+    ifttt				*Ifttt
+
+    startTime			time.Time
+    stats				dispatcherStats
+    limiter				*rateLimiter
+    bans				*banList
 	
     exit 				chan bool
     
 	chanMqttStateChange chan bool
 	chanMqttNodeChange 	chan bool
 
-	httpLocation		chan Location
+	httpEvent			chan webhookEvent
 }
 
 //
@@ -55,39 +139,104 @@ type Dispatcher struct {
 func NewDispatcher(config *DispatcherConfiguration, exit chan bool) (dispatcher *Dispatcher) {
 	log.Debugf("NewDispatcher(): begin")
 
-    dispatcher = &Dispatcher{config: config, exit: exit}
+    dispatcher = &Dispatcher{config: config, exit: exit, startTime: time.Now(), limiter: newRateLimiter(), bans: newBanList()}
 	
-	dispatcher.httpLocation  = make(chan Location)
+	dispatcher.httpEvent  			= make(chan webhookEvent)
+	dispatcher.chanMqttStateChange	= make(chan bool, 1)
 
 	// set callbacks
 	dispatcher.config.MqttOptions.SetStateChangeCallback(dispatcher.stateChangeCallback)
 	dispatcher.config.MqttOptions.SetNodeChangeCallback(dispatcher.nodeChangeCallback)
+	dispatcher.config.MqttOptions.SetWriteCallback(dispatcher.writeCallback)
+	dispatcher.config.MqttOptions.SetRPCCallback(dispatcher.rpcCallback)
 
 	log.Debugf("NewDispatcher(): end")
 	
 	return dispatcher
 }
 //
+// the current settings; these may be replaced at any time by a msgbus Write or a reload
+//
+func (dispatcher *Dispatcher) Config() *DispatcherConfiguration {
+	dispatcher.configMutex.RLock()
+	defer dispatcher.configMutex.RUnlock()
+
+	return dispatcher.config
+}
+//
+//
+func (dispatcher *Dispatcher) setConfig(config *DispatcherConfiguration) {
+	dispatcher.configMutex.Lock()
+	defer dispatcher.configMutex.Unlock()
+
+	dispatcher.config = config
+}
+//
 //
 func (dispatcher *Dispatcher) Run() (err error) {
 	log.Debugf("DispatcherData::Run(): begin")
 
-    dispatcher.mqtt, err = NewConnector(dispatcher.config.MqttOptions)
+	config := dispatcher.Config()
+
+	var outboxRetry <-chan time.Time
+
+	if config.outboxPath != "" {
+		dispatcher.outbox, err = NewOutbox(config.outboxPath, config.outboxMaxEntries, config.outboxMaxAge, config.outboxDropPolicy)
+		if err != nil {
+			log.Infof("Dispatcher::Run(): NewOutbox() error %s", err.Error())
+			return err
+		}
+		defer dispatcher.outbox.Close()
+
+		ticker := time.NewTicker(outboxRetryInterval)
+		defer ticker.Stop()
+
+		outboxRetry = ticker.C
+	}
+
+    dispatcher.mqtt, err = NewConnector(config.MqttOptions)
 	if err != nil {
-		log.Infof("Dispatcher::Run(): NewConnector() error ", err.Error())
+		log.Infof("Dispatcher::Run(): NewConnector() error %s", err.Error())
 		return err
 	}
 
-	dispatcher.mqtt.Connect()
+	if len(config.triggers) > 0 {
+		dispatcher.ifttt = NewIfttt(config, dispatcher.deadLetterCallback(config.iftttDeadLetter))
+		dispatcher.ifttt.Start()
+		defer dispatcher.ifttt.Stop()
+
+		for _, trigger := range config.triggers {
+			log.Debugf("Dispatcher::Run(): trigger '%s' on '%s'", trigger.name, trigger.topic)
+			dispatcher.mqtt.Subscribe(trigger.topic, config.MqttOptions.Qos, dispatcher.ifttt.handler(trigger))
+		}
+	}
+
+	for _, rule := range config.forwards {
+		log.Debugf("Dispatcher::Run(): forwarding '%s' with rule '%s'", rule.topic, rule.name)
+
+		worker := newOutboundWorker("forward." + rule.name, rule.timeout, rule.retries, nil, dispatcher.deadLetterCallback(rule.deadLetter))
+		worker.Start()
+		defer worker.Stop()
+
+		dispatcher.mqtt.Subscribe(rule.topic, config.MqttOptions.Qos, rule.handler(worker))
+	}
+
+	if config.haDiscovery {
+		dispatcher.mqtt.Subscribe(config.haPrefix + "/status", config.MqttOptions.Qos, dispatcher.onHaStatus)
+	}
+
+	if err := dispatcher.mqtt.Connect(); err != nil {
+		log.Infof("Dispatcher::Run(): Connect() error %s", err.Error())
+	}
 	
-	httpServer := NewHttpServer(dispatcher.config, dispatcher)
+	httpServer := NewHttpServer(config, dispatcher)
 	if httpServer == nil {
-		log.Infof("Dispatcher::Run(): NewHttpServer() error ", err.Error())
-		return err
+		log.Infof("Dispatcher::Run(): NewHttpServer() error")
+		return errors.New("could not create HTTP server")
 	}
 
 	if err := httpServer.Start(); err != nil {
-		log.Infof("Dispatcher::Run(): failed to start HTTP server; ", err.Error())
+		log.Infof("Dispatcher::Run(): failed to start HTTP server; %s", err.Error())
 		return err
 	}
 	
@@ -99,11 +248,27 @@ func (dispatcher *Dispatcher) Run() (err error) {
 			 * incoming http data
 			 *
 			 */
-			case r := <- dispatcher.httpLocation:
-				log.Debugf("Dispatcher::Run(): got 'httpLocation'")
+			case r := <- dispatcher.httpEvent:
+				log.Debugf("Dispatcher::Run(): got 'httpEvent'")
 				log.Debugf("Dispatcher::Run(): r = %+v", r)
 
-				dispatcher.mqtt.PublishUpdate(r.dataId, r)
+				// the channel is buffered so this never blocks, even if the HTTP handler stopped waiting
+				r.result <- dispatcher.publishEvent(r)
+
+			/******************************************************************************************************************
+			 * MQTT (re)connected; deliver whatever piled up in the outbox
+			 *
+			 */
+			case connected := <- dispatcher.chanMqttStateChange:
+				log.Debugf("Dispatcher::Run(): got 'chanMqttStateChange'; connected = %t", connected)
+
+				if connected {
+					dispatcher.publishDiscovery()
+					dispatcher.replayOutbox()
+				}
+
+			case <- outboxRetry:
+				dispatcher.replayOutbox()
 
 			/******************************************************************************************************************
 			 * exit
@@ -111,6 +276,7 @@ func (dispatcher *Dispatcher) Run() (err error) {
 			 */
 			case <- dispatcher.exit:
 				log.Debugf("Dispatcher::Run(): exit")
+				dispatcher.mqtt.Close()
 				shouldRun = false
 				break
 		}
@@ -121,6 +287,267 @@ func (dispatcher *Dispatcher) Run() (err error) {
     return nil
 }
 
+/******************************************************************************************************************
+* publishing
+*
+*/
+
+const outboxRetryInterval = 10 * time.Second
+
+//
+//
+func (dispatcher *Dispatcher) publishEvent(r webhookEvent) publishResult {
+	if dispatcher.outbox != nil && dispatcher.outbox.Len() > 0 {
+		dispatcher.replayOutbox()
+	}
+
+	// once something is queued, newer events have to queue up behind it to keep the order
+	if dispatcher.outbox != nil && (dispatcher.outbox.Len() > 0 || !dispatcher.mqtt.IsConnected()) {
+		return dispatcher.queueEvent(r)
+	}
+
+	messageId, err := dispatcher.mqtt.PublishUpdateWithOptions(r.dataId, r.payload, dispatcher.publishOptions(r))
+	if err != nil {
+		log.Infof("Dispatcher::publishEvent(): publish of '%s' for API key '%s' failed; %s", r.dataId, r.apiKey, err.Error())
+
+		if dispatcher.outbox != nil {
+			return dispatcher.queueEvent(r)
+		}
+
+		dispatcher.stats.add(&dispatcher.stats.failed)
+	} else {
+		dispatcher.stats.add(&dispatcher.stats.published)
+	}
+
+	return publishResult{messageId: messageId, err: err}
+}
+//
+//
+func (dispatcher *Dispatcher) queueEvent(r webhookEvent) publishResult {
+	if err := dispatcher.outbox.Append(r); err != nil {
+		log.Infof("Dispatcher::queueEvent(): failed to queue '%s' for API key '%s'; %s", r.dataId, r.apiKey, err.Error())
+		dispatcher.stats.add(&dispatcher.stats.failed)
+		return publishResult{err: err}
+	}
+
+	dispatcher.stats.add(&dispatcher.stats.queued)
+
+	log.Debugf("Dispatcher::queueEvent(): queued '%s' for API key '%s' (%s)", r.dataId, r.apiKey, r.requestId)
+
+	return publishResult{queued: true}
+}
+//
+//
+func (dispatcher *Dispatcher) publishOptions(r webhookEvent) *PublishOptions {
+	config := dispatcher.Config()
+
+	return &PublishOptions{
+		Topic:		r.topic,
+		Qos:		config.dataIdQos(r.dataId),
+		Retain:		config.dataIdRetain(r.dataId),
+		Properties:	dispatcher.publishProperties(r),
+	}
+}
+//
+// request metadata travels as MQTT 5 properties. MQTT 3.1.1 has no properties, so there the API key name is
+// only in the payload for the location and enriched modes; a passthrough payload is left alone, use
+// '{{ .ApiKey }}' in the topic template to tell the keys apart
+//
+func (dispatcher *Dispatcher) publishProperties(r webhookEvent) *PublishProperties {
+	options := dispatcher.Config().MqttOptions
+
+	return &PublishProperties{
+		ContentType:		options.ContentType,
+		MessageExpiry:		options.MessageExpiry,
+		ResponseTopic:		options.ResponseTopic,
+		CorrelationData:	[]byte(r.requestId),
+		UserProperties:		[]UserProperty{
+			{Key: "request_id",	Value: r.requestId},
+			{Key: "source_ip",	Value: r.remote},
+			{Key: "api_key",	Value: r.apiKey},
+		},
+	}
+}
+//
+// publishes queued events in order, stopping at the first failure so nothing is overtaken
+//
+func (dispatcher *Dispatcher) replayOutbox() {
+	if dispatcher.outbox == nil {
+		return
+	}
+
+	for dispatcher.mqtt.IsConnected() {
+		entry := dispatcher.outbox.Peek()
+		if entry == nil {
+			return
+		}
+
+		r := entry.event()
+
+		if _, err := dispatcher.mqtt.PublishUpdateWithOptions(r.dataId, r.payload, dispatcher.publishOptions(r)); err != nil {
+			log.Infof("Dispatcher::replayOutbox(): publish of '%s' for API key '%s' failed; %s", entry.DataId, entry.ApiKey, err.Error())
+			return
+		}
+
+		log.Debugf("Dispatcher::replayOutbox(): published '%s' for API key '%s' (%s)", entry.DataId, entry.ApiKey, entry.RequestId)
+
+		dispatcher.stats.add(&dispatcher.stats.published)
+
+		if err := dispatcher.outbox.Remove(); err != nil {
+			log.Infof("Dispatcher::replayOutbox(): %s", err.Error())
+			return
+		}
+	}
+}
+
+/******************************************************************************************************************
+* msgbus requests
+*
+*/
+
+//
+// runtime settings that other nodes can change with '<setting>.Write'. The new value is published as an
+// Update so it can be read back
+//
+func (dispatcher *Dispatcher) writeCallback(src string, dataId string, value json.RawMessage) (err error) {
+	config := *dispatcher.Config()
+
+	switch dataId {
+	case "debug":
+		var debug bool
+		if err = json.Unmarshal(value, &debug); err == nil {
+			log.EnableDebugLog(debug)
+		}
+
+	case "payload_mode":
+		if err = json.Unmarshal(value, &config.payloadMode); err == nil && !isValidPayloadMode(config.payloadMode) {
+			err = fmt.Errorf("unknown mode '%s'", config.payloadMode)
+		}
+
+	case "wait_for_publish":
+		err = json.Unmarshal(value, &config.waitForPublish)
+
+	case "publish_wait":
+		var seconds int
+		if err = json.Unmarshal(value, &seconds); err == nil {
+			config.publishWait = time.Duration(seconds) * time.Second
+		}
+
+	default:
+		return fmt.Errorf("unknown setting '%s'", dataId)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	dispatcher.setConfig(&config)
+
+	log.Infof("Dispatcher::writeCallback(): '%s' set '%s' to %s", src, dataId, string(value))
+
+	_, err = dispatcher.mqtt.PublishUpdate(dataId, value)
+
+	return err
+}
+//
+//
+func (dispatcher *Dispatcher) rpcCallback(src string, method string, params json.RawMessage) (interface{}, error) {
+	log.Debugf("Dispatcher::rpcCallback(): '%s' called '%s'", src, method)
+
+	switch method {
+	case "ping":
+		return "pong", nil
+
+	case "stats":
+		return dispatcher.statsReport(), nil
+
+	case "nodes":
+		return dispatcher.mqtt.Nodes(), nil
+
+	case "reload":
+		if err := dispatcher.reload(); err != nil {
+			return nil, err
+		}
+
+		return "reloaded", nil
+	}
+
+	return nil, fmt.Errorf("unknown method '%s'", method)
+}
+//
+//
+func (dispatcher *Dispatcher) reload() error {
+	current := dispatcher.Config()
+
+	if current.configFile == "" {
+		return errors.New("no configuration file to reload")
+	}
+
+	loaded := NewConfig()
+
+	if err := loaded.ReadConfig(current.configFile); err != nil {
+		return err
+	}
+
+	config := *current
+	config.copyRuntimeSettings(loaded)
+
+	discovered := haDiscoveryTopics(current)
+
+	dispatcher.setConfig(&config)
+
+	log.Infof("Dispatcher::reload(): reloaded '%s'", current.configFile)
+
+	// data IDs may have come or gone
+	dispatcher.removeDiscovery(discovered)
+	dispatcher.publishDiscovery()
+
+	return nil
+}
+
+/******************************************************************************************************************
+* outbound HTTP
+*
+*/
+
+// what is published to a dead letter topic
+type deadLetter struct {
+	Rule				string			`json:"rule"`
+	Topic				string			`json:"topic"`
+	Payload				interface{}		`json:"payload"`
+	Error				string			`json:"error"`
+	Attempts			int				`json:"attempts"`
+	Time				int64			`json:"time"`
+}
+
+//
+// nil if there's no dead letter topic, in which case failures are only logged
+//
+func (dispatcher *Dispatcher) deadLetterCallback(topic string) DeadLetterCallback {
+	if topic == "" {
+		return nil
+	}
+
+	return func(r *outboundRequest, attempts int, err error) {
+		d := deadLetter{
+			Rule:		r.rule,
+			Topic:		r.topic,
+			Payload:	string(r.payload),
+			Error:		err.Error(),
+			Attempts:	attempts,
+			Time:		time.Now().Unix(),
+		}
+
+		if json.Valid(r.payload) {
+			d.Payload = json.RawMessage(r.payload)
+		}
+
+		if err := dispatcher.mqtt.publish(topic, d); err != nil {
+			log.Infof("Dispatcher::deadLetterCallback(): publish to '%s' failed; %s", topic, err.Error())
+		}
+	}
+}
+
 /******************************************************************************************************************
 * MQTT transitions
 *
@@ -128,10 +555,22 @@ func (dispatcher *Dispatcher) Run() (err error) {
 
 //
 //
-func (dispatcher *Dispatcher) stateChangeCallback(connected bool) {
+func (dispatcher *Dispatcher) stateChangeCallback(connected bool, broker string) {
 	log.Debugf("Dispatcher::stateChangeCallback()")
+
+	if connected {
+		log.Infof("Dispatcher::stateChangeCallback(): connected to '%s'", broker)
+	} else {
+		log.Infof("Dispatcher::stateChangeCallback(): lost connection to '%s'", broker)
+	}
+
+	// don't hold up the MQTT client; a missed notification is caught by the outbox retry ticker
+	select {
+	case dispatcher.chanMqttStateChange <- connected:
+	default:
+	}
 }
 
 func (dispatcher *Dispatcher) nodeChangeCallback(nodename string, status MsgbusStatus, uptime int64) {
-	log.Debugf("Dispatcher::nodeChangeCallback()")
+	log.Infof("Dispatcher::nodeChangeCallback(): node '%s' is %s; uptime = %d", nodename, status, uptime)
 }
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"net/http"
+	"encoding/base64"
+	"time"
+	"text/template"
+	"github.com/mikejac/log.golang"
+)
+
+//
+// forwarding rules, from the [forward.<name>] sections, send MQTT messages matching topic to any HTTP endpoint.
+// url and body are text/templates over the message, the same as the IFTTT values; without a body template
+// the payload is sent as is. Extra headers come from [forward.<name>.headers]. Each rule has its own
+// outboundWorker so a slow endpoint doesn't hold up the others
+//
+
+type forwardRule struct {
+	name				string
+	topic				string					// MQTT topic filter
+	method				string
+	url					*template.Template
+	body				*template.Template		// nil to send the payload
+	header				http.Header
+
+	username			string					// basic auth
+	password			string
+	bearerToken			string
+
+	retries				int
+	timeout				time.Duration
+	deadLetter			string					// topic for messages that couldn't be delivered; none if empty
+}
+
+//
+// returns the MessageHandler for the rule's subscription
+//
+func (rule *forwardRule) handler(worker *outboundWorker) MessageHandler {
+	return func(topic string, payload []byte) {
+		r, err := rule.request(topic, payload)
+		if err != nil {
+			log.Infof("forwardRule::handler(): rule '%s' on '%s'; %s", rule.name, topic, err.Error())
+			worker.fail(&outboundRequest{rule: "forward." + rule.name, topic: topic, payload: payload}, 0, err)
+			return
+		}
+
+		worker.enqueue(r)
+	}
+}
+//
+//
+func (rule *forwardRule) request(topic string, payload []byte) (*outboundRequest, error) {
+	msg := newMqttMessage(topic, payload)
+
+	u, err := renderMessageTemplate(rule.url, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	body := payload
+
+	if rule.body != nil {
+		b, err := renderMessageTemplate(rule.body, msg)
+		if err != nil {
+			return nil, err
+		}
+
+		body = []byte(b)
+	}
+
+	r := &outboundRequest{
+		rule:		"forward." + rule.name,
+		method:		rule.method,
+		url:		u,
+		header:		rule.header.Clone(),
+		body:		body,
+		topic:		topic,
+		payload:	payload,
+	}
+
+	if rule.bearerToken != "" {
+		r.header.Set("Authorization", "Bearer " + rule.bearerToken)
+	} else if rule.username != "" {
+		r.header.Set("Authorization", "Basic " + base64.StdEncoding.EncodeToString([]byte(rule.username + ":" + rule.password)))
+	}
+
+	return r, nil
+}
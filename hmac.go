@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+//
+// HMAC-SHA256 request signing for an API key, configured in [hmac.<key name>]. The sender puts the unix time
+// in the timestamp header and the hex HMAC-SHA256 of
+//
+//   <method>\n<path>\n<query>\n<timestamp>.<body>
+//
+// in the signature header, with path and query exactly as in the request line ('/ifttt/gh/door', 'state=open',
+// the query empty if there is none). Requests outside the window, or with a signature already seen within it,
+// are rejected.
+//
+// With an empty timestamp_header only the body is signed, which is what GitHub does with
+// 'header = X-Hub-Signature-256' and 'prefix = sha256='. There is no replay protection then and the path isn't
+// covered, so limit the key to its data IDs in [apikey.<name>]; the payload has to be in the body, a request
+// with an empty body or a query string is refused.
+//
+// Keys with HMAC may be given by name in the URL, so the secret never has to be part of it
+//
+
+const (
+	hmacDefaultHeader			string = "X-Signature"
+	hmacDefaultTimestampHeader	string = "X-Timestamp"
+	hmacDefaultWindow			time.Duration = 5 * time.Minute
+)
+
+var (
+	errSignatureMissing		= errors.New("missing signature")
+	errSignatureInvalid		= errors.New("invalid signature")
+	errSignatureExpired		= errors.New("timestamp outside the allowed window")
+	errSignatureReplayed	= errors.New("signature already used")
+	errSignatureNoBody		= errors.New("only the body is signed, so the payload must be in it and not in the URL")
+)
+
+type hmacConfig struct {
+	secret				[]byte
+	header				string
+	timestampHeader		string					// empty to sign the body only
+	prefix				string					// in front of the hex signature, e.g. 'sha256='
+	window				time.Duration
+
+	replays				*replayCache			// carried over when the configuration is reloaded
+}
+
+type replayCache struct {
+	mutex				sync.Mutex
+	seen				map[string]time.Time	// signatures used within the window
+}
+
+//
+//
+func newHmacConfig(secret string) *hmacConfig {
+	return &hmacConfig{
+		secret:				[]byte(secret),
+		header:				hmacDefaultHeader,
+		timestampHeader:	hmacDefaultTimestampHeader,
+		window:				hmacDefaultWindow,
+		replays:			&replayCache{seen: make(map[string]time.Time)},
+	}
+}
+//
+//
+func (h *hmacConfig) verify(r *http.Request, body []byte) error {
+	signature := r.Header.Get(h.header)
+	if signature == "" {
+		return errSignatureMissing
+	}
+
+	if !strings.HasPrefix(signature, h.prefix) {
+		return errSignatureInvalid
+	}
+
+	got, err := hex.DecodeString(strings.TrimPrefix(signature, h.prefix))
+	if err != nil {
+		return errSignatureInvalid
+	}
+
+	mac := hmac.New(sha256.New, h.secret)
+
+	var timestamp time.Time
+
+	if h.timestampHeader == "" {
+		// the query string is empty by now if all it had was the API key
+		if len(bytes.TrimSpace(body)) == 0 || r.URL.RawQuery != "" {
+			return errSignatureNoBody
+		}
+	} else {
+		ts := r.Header.Get(h.timestampHeader)
+
+		seconds, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return errSignatureExpired
+		}
+
+		timestamp = time.Unix(seconds, 0)
+
+		if d := time.Since(timestamp); d > h.window || d < -h.window {
+			return errSignatureExpired
+		}
+
+		mac.Write([]byte(signedRequestLine(r)))
+		mac.Write([]byte(ts + "."))
+	}
+
+	mac.Write(body)
+
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return errSignatureInvalid
+	}
+
+	if h.timestampHeader != "" && !h.remember(hex.EncodeToString(got), timestamp) {
+		return errSignatureReplayed
+	}
+
+	return nil
+}
+//
+// '<method>\n<path>\n<query>\n' from the request line as received, before the API key was taken out of it
+//
+func signedRequestLine(r *http.Request) string {
+	target := r.RequestURI
+	if target == "" {
+		target = r.URL.RequestURI()
+	}
+
+	f := strings.SplitN(target, "?", 2)
+	if len(f) == 1 {
+		f = append(f, "")
+	}
+
+	return r.Method + "\n" + f[0] + "\n" + f[1] + "\n"
+}
+//
+// false if the signature was seen before; entries are kept until their timestamp leaves the window
+//
+func (h *hmacConfig) remember(signature string, timestamp time.Time) bool {
+	h.replays.mutex.Lock()
+	defer h.replays.mutex.Unlock()
+
+	now := time.Now()
+
+	for s, t := range h.replays.seen {
+		if now.Sub(t) > h.window {
+			delete(h.replays.seen, s)
+		}
+	}
+
+	if _, ok := h.replays.seen[signature]; ok {
+		return false
+	}
+
+	h.replays.seen[signature] = timestamp
+
+	return true
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+//
+// target is the path and query of the request; without a timestamp only the body is signed
+//
+func sign(secret string, method string, target string, ts string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	if ts != "" {
+		path, query := target, ""
+		if i := strings.Index(target, "?"); i >= 0 {
+			path, query = target[:i], target[i + 1:]
+		}
+
+		mac.Write([]byte(method + "\n" + path + "\n" + query + "\n" + ts + "."))
+	}
+	mac.Write([]byte(body))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHmacVerify(t *testing.T) {
+	h := newHmacConfig("s3cret")
+	body := `{"a": 1}`
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-10 * time.Minute).Unix(), 10)
+
+	target := "/ifttt/k/x"
+
+	tests := []struct {
+		name			string
+		ts				string
+		signature		string
+		want			error
+	}{
+		{"valid",		now,	sign("s3cret", "POST", target, now, body),		nil},
+		{"replayed",	now,	sign("s3cret", "POST", target, now, body),		errSignatureReplayed},
+		{"missing",		now,	"",												errSignatureMissing},
+		{"wrong secret",	now,	sign("other", "POST", target, now, body),		errSignatureInvalid},
+		{"not hex",		now,	"xyz",											errSignatureInvalid},
+		{"expired",		old,	sign("s3cret", "POST", target, old, body),		errSignatureExpired},
+		{"no timestamp",	"",		sign("s3cret", "POST", target, "", body),		errSignatureExpired},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", target, strings.NewReader(body))
+		r.Header.Set(hmacDefaultTimestampHeader, tt.ts)
+		if tt.signature != "" {
+			r.Header.Set(hmacDefaultHeader, tt.signature)
+		}
+
+		if err := h.verify(r, []byte(body)); err != tt.want {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestHmacTamperedRequest(t *testing.T) {
+	h := newHmacConfig("s3cret")
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := sign("s3cret", "GET", "/ifttt/k/door?state=open", ts, "")
+
+	tests := []struct {
+		name			string
+		method			string
+		target			string
+		want			error
+	}{
+		{"other data ID",	"GET",	"/ifttt/k/garage?state=open",	errSignatureInvalid},
+		{"other query",		"GET",	"/ifttt/k/door?state=closed",	errSignatureInvalid},
+		{"added query",		"GET",	"/ifttt/k/door?state=open&a=1",	errSignatureInvalid},
+		{"other method",	"POST",	"/ifttt/k/door?state=open",		errSignatureInvalid},
+		{"as signed",		"GET",	"/ifttt/k/door?state=open",		nil},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		r.Header.Set(hmacDefaultTimestampHeader, ts)
+		r.Header.Set(hmacDefaultHeader, signature)
+
+		if err := h.verify(r, nil); err != tt.want {
+			t.Errorf("%s: err = %v, want %v", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestHmacBodyOnly(t *testing.T) {
+	h := newHmacConfig("s3cret")
+	h.header			= "X-Hub-Signature-256"
+	h.timestampHeader	= ""
+	h.prefix			= "sha256="
+
+	body := `{"a": 1}`
+
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("POST", "/ifttt/k/x", strings.NewReader(body))
+		r.Header.Set(h.header, "sha256=" + sign("s3cret", "POST", "", "", body))
+
+		if err := h.verify(r, []byte(body)); err != nil {
+			t.Errorf("attempt %d: %v", i + 1, err)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/ifttt/k/x", strings.NewReader(body))
+	r.Header.Set(h.header, sign("s3cret", "POST", "", "", body))
+
+	if err := h.verify(r, []byte(body)); err != errSignatureInvalid {
+		t.Errorf("without prefix: err = %v", err)
+	}
+
+	// the query isn't signed, so it can't carry the payload; an empty body can be signed once and reused
+	for _, tt := range []struct {
+		target, body	string
+	}{
+		{"/ifttt/k/x?state=open", ""},
+		{"/ifttt/k/x?state=open", body},
+		{"/ifttt/k/x", "  "},
+	} {
+		r := httptest.NewRequest("POST", tt.target, strings.NewReader(tt.body))
+		r.Header.Set(h.header, "sha256=" + sign("s3cret", "POST", "", "", tt.body))
+
+		if err := h.verify(r, []byte(tt.body)); err != errSignatureNoBody {
+			t.Errorf("%s %q: err = %v, want %v", tt.target, tt.body, err, errSignatureNoBody)
+		}
+	}
+}
+
+func TestHmacReplayAfterReload(t *testing.T) {
+	newConfig := func() *DispatcherConfiguration {
+		key, _ := newAPIKey("k", "plain-key")
+		key.hmac = newHmacConfig("s3cret")
+
+		config := NewConfig()
+		config.apikeys = []*apiKey{key}
+
+		return config
+	}
+
+	current := newConfig()
+
+	body := `{"a": 1}`
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	request := func() error {
+		r := httptest.NewRequest("POST", "/ifttt/k/x", strings.NewReader(body))
+		r.Header.Set(hmacDefaultTimestampHeader, ts)
+		r.Header.Set(hmacDefaultHeader, sign("s3cret", "POST", "/ifttt/k/x", ts, body))
+
+		return current.apiKeyByName("k").hmac.verify(r, []byte(body))
+	}
+
+	if err := request(); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := *current
+	reloaded.copyRuntimeSettings(newConfig())
+	current = &reloaded
+
+	if err := request(); err != errSignatureReplayed {
+		t.Errorf("after reload: err = %v, want %v", err, errSignatureReplayed)
+	}
+}
@@ -0,0 +1,281 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"github.com/mikejac/log.golang"
+)
+
+//
+// Home Assistant MQTT discovery. For every [dataid.<name>] section a retained config message is published to
+// '<prefix>/<component>/<node>/<dataId>/config' so the data ID shows up as an entity, without any YAML on the
+// Home Assistant side. Location webhooks become a device_tracker, anything else an event unless the section
+// says otherwise with 'ha_component'
+//
+
+const (
+	haComponentDeviceTracker	string = "device_tracker"
+	haComponentBinarySensor		string = "binary_sensor"
+	haComponentSensor			string = "sensor"
+	haComponentEvent			string = "event"
+	haComponentNone				string = "none"			// no discovery for this data ID
+
+	haDefaultPrefix				string = "homeassistant"
+	haEventType					string = "webhook"
+)
+
+type haDevice struct {
+	Identifiers			[]string		`json:"identifiers"`
+	Name				string			`json:"name"`
+	Model				string			`json:"model,omitempty"`
+}
+
+type haConfig struct {
+	Name				string			`json:"name"`
+	UniqueId			string			`json:"unique_id"`
+	ObjectId			string			`json:"object_id,omitempty"`
+	StateTopic			string			`json:"state_topic"`
+	ValueTemplate		string			`json:"value_template,omitempty"`
+	JsonAttrTopic		string			`json:"json_attributes_topic,omitempty"`
+	EventTypes			[]string		`json:"event_types,omitempty"`
+	AvailabilityTopic	string			`json:"availability_topic"`
+	AvailabilityTmpl	string			`json:"availability_template"`
+	PayloadAvailable	string			`json:"payload_available"`
+	PayloadNotAvail		string			`json:"payload_not_available"`
+	Device				haDevice		`json:"device"`
+}
+
+var haInvalidIdChars = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+//
+//
+func isValidHaComponent(component string) bool {
+	switch component {
+	case haComponentDeviceTracker, haComponentBinarySensor, haComponentSensor, haComponentEvent, haComponentNone:
+		return true
+	}
+
+	return false
+}
+//
+// node and object IDs in discovery topics may only contain [a-zA-Z0-9_-]
+//
+func haId(s string) string {
+	return haInvalidIdChars.ReplaceAllString(s, "_")
+}
+//
+// Home Assistant announces itself on '<prefix>/status' when it starts; the discovery config is sent again then
+//
+func (dispatcher *Dispatcher) onHaStatus(topic string, payload []byte) {
+	if string(payload) == statusOnline {
+		dispatcher.publishDiscovery()
+	}
+}
+//
+//
+func (dispatcher *Dispatcher) publishDiscovery() {
+	config := dispatcher.Config()
+
+	if !config.haDiscovery {
+		return
+	}
+
+	dataIds := make([]string, 0, len(config.dataIds))
+	for dataId := range config.dataIds {
+		dataIds = append(dataIds, dataId)
+	}
+	sort.Strings(dataIds)
+
+	for _, dataId := range dataIds {
+		component, c, err := dispatcher.haDiscoveryConfig(config, dataId)
+		if err != nil {
+			log.Infof("Dispatcher::publishDiscovery(): skipping '%s'; %s", dataId, err.Error())
+			continue
+		}
+
+		if component == haComponentNone {
+			continue
+		}
+
+		topic := haDiscoveryTopic(config, component, dataId)
+
+		log.Debugf("Dispatcher::publishDiscovery(): topic = %s", topic)
+
+		if _, err := dispatcher.mqtt.PublishUpdateWithOptions(dataId, c, &PublishOptions{Topic: topic, Qos: config.MqttOptions.Qos, Retain: true, NoCache: true}); err != nil {
+			log.Infof("Dispatcher::publishDiscovery(): publish of '%s' failed; %s", topic, err.Error())
+		}
+	}
+}
+//
+// the discovery topics in use for config, by data ID
+//
+func haDiscoveryTopics(config *DispatcherConfiguration) map[string]string {
+	topics := make(map[string]string)
+
+	if !config.haDiscovery {
+		return topics
+	}
+
+	for dataId := range config.dataIds {
+		if component := haDataIdComponent(config, dataId); component != haComponentNone {
+			topics[dataId] = haDiscoveryTopic(config, component, dataId)
+		}
+	}
+
+	return topics
+}
+//
+// an empty retained message removes the entity from Home Assistant; for data IDs that were dropped from the
+// configuration or moved to another component
+//
+func (dispatcher *Dispatcher) removeDiscovery(before map[string]string) {
+	after := haDiscoveryTopics(dispatcher.Config())
+
+	for dataId, topic := range before {
+		if after[dataId] == topic {
+			continue
+		}
+
+		log.Debugf("Dispatcher::removeDiscovery(): topic = %s", topic)
+
+		if err := dispatcher.mqtt.ClearRetained(topic); err != nil {
+			log.Infof("Dispatcher::removeDiscovery(): clearing '%s' failed; %s", topic, err.Error())
+		}
+	}
+}
+//
+//
+func haDiscoveryTopic(config *DispatcherConfiguration, component string, dataId string) string {
+	return config.haPrefix + "/" + component + "/" + haId(config.MqttOptions.Nodename) + "/" + haId(dataId) + "/config"
+}
+//
+// device_tracker for location webhooks, event for anything else, unless ha_component says otherwise
+//
+func haDataIdComponent(config *DispatcherConfiguration, dataId string) string {
+	if d := config.dataIds[dataId]; d != nil && d.haComponent != "" {
+		return d.haComponent
+	}
+
+	if config.dataIdPayloadMode(dataId) == payloadModeLocation {
+		return haComponentDeviceTracker
+	}
+
+	return haComponentEvent
+}
+//
+//
+func (dispatcher *Dispatcher) haDiscoveryConfig(config *DispatcherConfiguration, dataId string) (string, *haConfig, error) {
+	d := config.dataIds[dataId]
+
+	component := haDataIdComponent(config, dataId)
+	if component == haComponentNone {
+		return component, nil, nil
+	}
+
+	stateTopic, err := config.dataIdStateTopic(dataId, dispatcher.mqtt.topicUpdate(dataId))
+	if err != nil {
+		return component, nil, err
+	}
+
+	nodename := config.MqttOptions.Nodename
+
+	c := &haConfig{
+		Name:				d.haName,
+		UniqueId:			haId(nodename) + "_" + haId(dataId),
+		ObjectId:			haId(dataId),
+		StateTopic:			stateTopic,
+		ValueTemplate:		d.haValueTemplate,
+		AvailabilityTopic:	dispatcher.mqtt.topicUpdate(msgbusStatus),
+		AvailabilityTmpl:	"{{ value_json.status }}",
+		PayloadAvailable:	statusOnline,
+		PayloadNotAvail:	statusOffline,
+		Device:				haDevice{
+			Identifiers:	[]string{haId(nodename)},
+			Name:			nodename,
+			Model:			"iftt-mqtt-webhook",
+		},
+	}
+
+	if c.Name == "" {
+		c.Name = dataId
+	}
+
+	switch component {
+	case haComponentDeviceTracker:
+		// the area is the zone; who and type end up as attributes
+		if c.ValueTemplate == "" {
+			c.ValueTemplate = "{{ value_json.area }}"
+		}
+		c.JsonAttrTopic = stateTopic
+
+	case haComponentEvent:
+		// every webhook is the same kind of event, with the payload as its attributes
+		if c.ValueTemplate == "" {
+			c.ValueTemplate = fmt.Sprintf(`{"event_type": "%s", "payload": {{ value }}}`, haEventType)
+		}
+		c.EventTypes = []string{haEventType}
+
+	case haComponentBinarySensor, haComponentSensor:
+		c.JsonAttrTopic = stateTopic
+	}
+
+	return component, c, nil
+}
+//
+// the state topic has to be fixed, so a topic template may depend on neither the payload nor the request; it
+// is rendered for two made up requests to find out
+//
+func (config *DispatcherConfiguration) dataIdStateTopic(dataId string, msgbusTopic string) (string, error) {
+	tmpl := config.dataIdTopicTemplate(dataId)
+	if tmpl == nil {
+		return msgbusTopic, nil
+	}
+
+	var topics [2]string
+
+	for i, placeholder := range []string{"a", "b"} {
+		topic, err := renderTopic(tmpl, topicData{
+			Domain:		config.MqttOptions.Domain,
+			Nodename:	config.MqttOptions.Nodename,
+			DataId:		dataId,
+			ApiKey:		placeholder,
+			RequestId:	placeholder,
+			Remote:		placeholder,
+			Payload:	map[string]interface{}{},
+		})
+
+		if err != nil {
+			return "", fmt.Errorf("topic depends on the payload; %s", err.Error())
+		}
+
+		topics[i] = topic
+	}
+
+	if topics[0] != topics[1] {
+		return "", fmt.Errorf("topic depends on the request")
+	}
+
+	return topics[0], nil
+}
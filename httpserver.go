@@ -21,19 +21,41 @@
 package main
 
 import (
+	"errors"
+	"math"
+	"net"
+	"strconv"
 	"strings"
 	"encoding/json"
 	"net/http"
 	"io/ioutil"	
+	"time"
 	"github.com/mikejac/log.golang"
+	"github.com/twinj/uuid"
 )
 
 type Location struct {
 	Who		string	`json:"who"`
 	Area	string	`json:"area"`
 	Type	string	`json:"type"`
+	ApiKey	string	`json:"apiKey,omitempty"`		// name of the API key used; set by us, whatever the caller sent
+}
+
+type webhookEvent struct {
+	requestId	string
+	remote		string				// address of the caller
+	apiKey		string				// name of the API key used
+	dataId		string
+	topic		string				// rendered from the topic template; empty for the msgbus layout
+	payload		interface{}
+
+	result		chan publishResult	// buffered; the dispatcher reports the outcome of the publish here
+}
 
-	dataId	string
+type publishResult struct {
+	messageId	uint16
+	queued		bool				// stored in the outbox, will be published once MQTT is back
+	err			error
 }
 
 type HttpServerData struct {
@@ -98,75 +120,417 @@ func (server *HttpServerData) Stop() (err error) {
 //
 //
 func (server *HttpServerData) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestId := newRequestId(r)
+
+	w.Header().Set(headerRequestId, requestId)
+
 	defer func() {
 		if rr := recover(); rr != nil {
 			log.Info("HttpServerData::ServeHTTP(): panic recovered; ", rr)
+			writeJSON(w, http.StatusInternalServerError, errorResponse{Error: "internal error", Status: http.StatusInternalServerError, RequestId: requestId})
 		}
 	}()
 
 	log.Debugf("HttpServerData::ServeHTTP(): begin")
 	
-	r.ParseForm()
-	
-    log.Debug("HttpServerData::ServeHTTP(): path   = ", r.URL.Path)
+    log.Debug("HttpServerData::ServeHTTP(): path   = ", redactPath(r.URL.Path))
     log.Debug("HttpServerData::ServeHTTP(): method = ", r.Method)
     log.Debug("HttpServerData::ServeHTTP(): addr   = ", r.RemoteAddr)
-	
-    if r.Method == http.MethodGet {
-	    f := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
-    	
-    	log.Debugf("HttpServerData::ServeHTTP(): f = %q", f)
-		
-		if len(f) < 3 {
-			http.NotFound(w, r)
-		} else {
-			if server.isValidAPIKey(f[1]) {
-				body, err := ioutil.ReadAll(r.Body)
-				if err != nil {
-					log.Info("HttpServerData::ServeHTTP(): err = ", err)
-					http.NotFound(w, r)
-				} else {
-					log.Debugf("HttpServerData::ServeHTTP(): body = %+v", string(body[:]))
-					var location Location
-			
-					err := json.Unmarshal(body, &location)
-					if err != nil {
-						log.Info("HttpServerData::ServeHTTP(): unmarshal err = ", err)
-						http.NotFound(w, r)
-					}
-			
-					location.dataId = f[2]
-
-					log.Debugf("HttpServerData::ServeHTTP(): location = %+v", location)
-
-					server.sendLocation(location)
-				}
-			} else {
-				log.Infof("HttpServerData::ServeHTTP(): invalid API key '%s'", f[1])
-				http.NotFound(w, r)
-			}
-		}
-    } else {
-    	log.Infof("HttpServerData::ServeHTTP(): not GET request")
-	    http.NotFound(w, r)
-    }
+    log.Debug("HttpServerData::ServeHTTP(): id     = ", requestId)
+
+	status, response := server.handle(w, r, requestId)
+
+	if status >= http.StatusBadRequest {
+		server.dispatcher.stats.add(&server.dispatcher.stats.rejected)
+	} else {
+		server.dispatcher.stats.add(&server.dispatcher.stats.accepted)
+	}
+
+	if e, ok := response.(errorResponse); ok {
+		e.Status	= status
+		e.RequestId	= requestId
+		response	= e
+	}
+
+	writeJSON(w, status, response)
 
 	log.Debugf("HttpServerData::ServeHTTP(): end")
 }
 //
+// returns the status code and either a successResponse or an errorResponse; ServeHTTP adds the request ID
+//
+func (server *HttpServerData) handle(w http.ResponseWriter, r *http.Request, requestId string) (int, interface{}) {
+    if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodPut {
+    	log.Infof("HttpServerData::handle(): unsupported method '%s'", r.Method)
+		w.Header().Set("Allow", allowedMethods)
+		return http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"}
+	}
+
+	// settings may be changed at runtime through msgbus, so stick to one version for the whole request
+	config := server.dispatcher.Config()
+
+	ip     := clientIP(config, r)
+	remote := clientAddr(config, r)
+
+	if banned, left := server.dispatcher.bans.banned(ip.String()); banned {
+		log.Debugf("HttpServerData::handle(): %s is banned", ip)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(left.Seconds()))))
+		return http.StatusForbidden, errorResponse{Error: "too many failed attempts"}
+	}
+
+	// before anything else, so guessing keys is slowed down as well
+	if ok, wait := server.dispatcher.limiter.ip.take(ip.String(), config.ipLimit); !ok {
+		return server.rateLimited(w, "client", wait)
+	}
+
+	apikey, dataId := apiKeyFromRequest(config, r)
+
+	if dataId == "" {
+		return http.StatusBadRequest, errorResponse{Error: "expected /ifttt/<apikey>/<dataId> or /ifttt/<dataId>"}
+	}
+
+	if apikey == "" {
+		return http.StatusUnauthorized, errorResponse{Error: "missing API key"}
+	}
+
+	key := config.lookupAPIKey(apikey)
+	if key == nil {
+		log.Infof("HttpServerData::handle(): invalid API key %s from %s", redactKey(apikey), remote)
+		server.authFailed(config, ip)
+		return http.StatusForbidden, errorResponse{Error: "invalid API key"}
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, config.maxBodySize))
+	if err != nil {
+		log.Infof("HttpServerData::handle(): API key '%s', err = %s", key.name, err.Error())
+
+		if _, ok := err.(*http.MaxBytesError); ok {
+			return http.StatusRequestEntityTooLarge, errorResponse{Error: "request body too large"}
+		}
+
+		return http.StatusBadRequest, errorResponse{Error: "unable to read request body"}
+	}
+
+	if key.hmac != nil {
+		if err := key.hmac.verify(r, body); err != nil {
+			log.Infof("HttpServerData::handle(): API key '%s' from %s; %s", key.name, remote, err.Error())
+			server.authFailed(config, ip)
+			return http.StatusUnauthorized, errorResponse{Error: err.Error()}
+		}
+	}
+
+	if err := key.authorize(r, ip, dataId); err != nil {
+		log.Infof("HttpServerData::handle(): API key '%s' from %s; %s", key.name, remote, err.Error())
+		return http.StatusForbidden, errorResponse{Error: err.Error()}
+	}
+
+	// only now, as a key given by name could otherwise be drained by anyone who knows the name
+	if ok, wait := server.dispatcher.limiter.key.take(key.name, config.keyRateLimit(key)); !ok {
+		return server.rateLimited(w, "API key '" + key.name + "'", wait)
+	}
+
+	if ok, wait := server.dispatcher.limiter.dataId.take(dataId, config.dataIdRateLimit(dataId)); !ok {
+		return server.rateLimited(w, "data ID '" + dataId + "'", wait)
+	}
+
+	log.Debugf("HttpServerData::handle(): key = '%s', body = %+v", key.name, string(body[:]))
+
+	event, err := server.newEvent(config, r, requestId, remote, key, dataId, body)
+	if err != nil {
+		log.Infof("HttpServerData::handle(): API key '%s', decode err = %s", key.name, err.Error())
+
+		if verr, ok := err.(*validationError); ok {
+			return http.StatusBadRequest, errorResponse{Error: "payload validation failed", Violations: verr.violations}
+		}
+
+		if err == errUnsupportedContentType {
+			return http.StatusUnsupportedMediaType, errorResponse{Error: err.Error()}
+		}
+
+		return http.StatusBadRequest, errorResponse{Error: "invalid payload; " + err.Error()}
+	}
+
+	log.Debugf("HttpServerData::handle(): event = %+v", event)
+
+	if !server.dispatcher.mqtt.IsConnected() && server.dispatcher.outbox == nil {
+		return http.StatusServiceUnavailable, errorResponse{Error: "MQTT broker not connected"}
+	}
+
+	response := successResponse{
+		Status:		"accepted",
+		RequestId:	requestId,
+		Topic:		event.topic,
+	}
+
+	if response.Topic == "" {
+		response.Topic = server.dispatcher.mqtt.topicUpdate(event.dataId)
+	}
+
+	timeout := time.NewTimer(config.publishWait)
+	defer timeout.Stop()
+
+	if !server.sendEvent(r, event, timeout.C) {
+		return http.StatusServiceUnavailable, errorResponse{Error: "dispatcher busy"}
+	}
+
+	if !config.waitForPublish {
+		return http.StatusAccepted, response
+	}
+
+	select {
+	case result := <- event.result:
+		if result.err == errOutboxFull {
+			return http.StatusServiceUnavailable, errorResponse{Error: "MQTT broker not connected and " + result.err.Error()}
+		} else if result.err != nil {
+			return http.StatusBadGateway, errorResponse{Error: "publish failed; " + result.err.Error()}
+		}
+
+		if result.queued {
+			response.Status = "queued"
+			return http.StatusAccepted, response
+		}
+
+		response.Status		= "published"
+		response.MessageId	= result.messageId
+
+		return http.StatusOK, response
+
+	case <- timeout.C:
+		return http.StatusGatewayTimeout, errorResponse{Error: "timed out waiting for publish acknowledgement"}
+
+	case <- r.Context().Done():
+		return http.StatusServiceUnavailable, errorResponse{Error: "request cancelled"}
+	}
+}
+//
+//
+func (server *HttpServerData) rateLimited(w http.ResponseWriter, what string, wait time.Duration) (int, interface{}) {
+	log.Infof("HttpServerData::rateLimited(): %s over its limit", what)
+
+	server.dispatcher.stats.add(&server.dispatcher.stats.limited)
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+
+	return http.StatusTooManyRequests, errorResponse{Error: "rate limit exceeded for " + what}
+}
+//
+// counts an invalid key or signature against ip
 //
-func (server *HttpServerData) sendLocation(location Location)  {
-    // send the location
-    server.dispatcher.httpLocation <- location
+func (server *HttpServerData) authFailed(config *DispatcherConfiguration, ip net.IP) {
+	if server.dispatcher.bans.fail(ip.String(), config) {
+		log.Infof("HttpServerData::authFailed(): %s banned for %s after %d failed attempts", ip, config.banDuration, config.maxFailures)
+		server.dispatcher.stats.add(&server.dispatcher.stats.banned)
+	}
 }
 //
 //
-func (server *HttpServerData) isValidAPIKey(apikey string) bool {
-	for _, key := range server.config.apikeys {
-		if key == apikey {
-			return true
+func (server *HttpServerData) newEvent(config *DispatcherConfiguration, r *http.Request, requestId string, remote string, key *apiKey, dataId string, body []byte) (event webhookEvent, err error) {
+	event.requestId	= requestId
+	event.remote	= remote
+	event.apiKey	= key.name
+	event.dataId	= dataId
+	event.result	= make(chan publishResult, 1)
+
+	mode   := config.dataIdPayloadMode(dataId)
+	schema := config.dataIdSchema(dataId)
+
+	log.Debugf("HttpServerData::newEvent(): dataId = '%s', mode = '%s'", dataId, mode)
+
+	var payload interface{}
+
+	if schema != nil || mode != payloadModeLocation {
+		if payload, err = decodePayload(r, body); err != nil {
+			return event, err
 		}
 	}
 
+	if schema != nil {
+		if isFormPayload(r, body) {
+			payload = schema.convertForm(payload)
+		}
+
+		if err = schema.Validate(payload); err != nil {
+			return event, err
+		}
+	}
+
+	if mode == payloadModeLocation {
+		var location Location
+
+		if location, err = decodeLocation(r, body); err != nil {
+			return event, err
+		}
+
+		location.ApiKey = key.name
+		payload = location
+	} else if mode == payloadModeEnriched {
+		payload = enrichPayload(payload, newEventMeta(remote, requestId, key.name, dataId))
+	}
+
+	event.payload = payload
+
+	if tmpl := config.dataIdTopicTemplate(dataId); tmpl != nil {
+		event.topic, err = renderTopic(tmpl, topicData{
+			Domain:		config.MqttOptions.Domain,
+			Nodename:	config.MqttOptions.Nodename,
+			DataId:		dataId,
+			ApiKey:		key.name,
+			RequestId:	requestId,
+			Remote:		remote,
+			Payload:	payload,
+		})
+
+		if err != nil {
+			return event, errors.New("topic; " + err.Error())
+		}
+	}
+
+	return event, nil
+}
+//
+//
+func (server *HttpServerData) sendEvent(r *http.Request, event webhookEvent, timeout <-chan time.Time) bool {
+    // send the event
+	select {
+	case server.dispatcher.httpEvent <- event:
+		return true
+	case <- timeout:
+	case <- r.Context().Done():
+	}
+
 	return false
-}
\ No newline at end of file
+}
+/******************************************************************************************************************
+ * API key
+ *
+ */
+
+const (
+	keySourcePath				string = "path"			// /ifttt/<apikey>/<dataId>
+	keySourceBearer				string = "bearer"		// Authorization: Bearer <apikey>
+	keySourceHeader				string = "header"		// X-API-Key: <apikey>, or whatever key_header says
+	keySourceQuery				string = "query"		// ?key=<apikey>, or whatever key_param says
+)
+
+//
+//
+func isValidKeySource(source string) bool {
+	switch source {
+	case keySourcePath, keySourceBearer, keySourceHeader, keySourceQuery:
+		return true
+	}
+
+	return false
+}
+//
+// the path is either /ifttt/<apikey>/<dataId> or, with the key elsewhere, /ifttt/<dataId>. The first of the
+// configured sources to have a key wins. A key in the query string is removed so it doesn't end up in the payload
+//
+func apiKeyFromRequest(config *DispatcherConfiguration, r *http.Request) (apikey string, dataId string) {
+	f := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	var pathKey string
+
+	switch len(f) {
+	case 2:
+		dataId = f[1]
+	case 3:
+		pathKey, dataId = f[1], f[2]
+	default:
+		return "", ""
+	}
+
+	query := r.URL.Query()
+
+	if _, ok := query[config.keyParam]; ok && containsString(config.keySources, keySourceQuery) {
+		defer func() {
+			query.Del(config.keyParam)
+			r.URL.RawQuery = query.Encode()
+		}()
+	}
+
+	for _, source := range config.keySources {
+		switch source {
+		case keySourcePath:
+			apikey = pathKey
+
+		case keySourceBearer:
+			if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+				apikey = strings.TrimSpace(auth[7:])
+			}
+
+		case keySourceHeader:
+			apikey = r.Header.Get(config.keyHeader)
+
+		case keySourceQuery:
+			apikey = query.Get(config.keyParam)
+		}
+
+		if apikey != "" {
+			log.Debugf("apiKeyFromRequest(): key %s from %s", redactKey(apikey), source)
+			break
+		}
+	}
+
+	return apikey, dataId
+}
+
+/******************************************************************************************************************
+ * responses
+ *
+ */
+
+const (
+	headerRequestId				string = "X-Request-Id"
+	allowedMethods				string = "GET, POST, PUT"
+)
+
+type errorResponse struct {
+	Error		string		`json:"error"`
+	Status		int			`json:"status"`
+	RequestId	string		`json:"request_id"`
+	Violations	[]string	`json:"violations,omitempty"`
+}
+
+type successResponse struct {
+	Status		string		`json:"status"`
+	RequestId	string		`json:"request_id"`
+	Topic		string		`json:"topic"`
+	MessageId	uint16		`json:"message_id,omitempty"`
+}
+
+//
+// a caller supplied X-Request-Id is reused so it can be correlated with the sender's own logs
+//
+func newRequestId(r *http.Request) string {
+	if id := r.Header.Get(headerRequestId); id != "" && len(id) <= 64 && isPrintable(id) {
+		return id
+	}
+
+	return uuid.NewV4().String()
+}
+//
+//
+func isPrintable(s string) bool {
+	for _, c := range s {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+//
+//
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", contentTypeJSON)
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(v); err != nil {
+		log.Info("writeJSON(): err = ", err)
+	}
+}
@@ -0,0 +1,158 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+//
+func newTestServer(config *DispatcherConfiguration) *HttpServerData {
+	return &HttpServerData{config: config, dispatcher: NewDispatcher(config, make(chan bool))}
+}
+//
+// the body is JSON unless the header says otherwise
+//
+func request(server *HttpServerData, path string, remote string, header http.Header, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", path, strings.NewReader(body))
+	r.RemoteAddr = remote
+	r.Header.Set("Content-Type", contentTypeJSON)
+
+	for name, values := range header {
+		r.Header[name] = values
+	}
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestKeyLimitAfterSignature(t *testing.T) {
+	key, _ := newAPIKey("gh", "unused")
+	key.hmac = newHmacConfig("secret")
+
+	config := NewConfig()
+	config.apikeys	= []*apiKey{key}
+	config.keyLimit	= rateLimit{rate: 1, burst: 2}
+
+	server := newTestServer(config)
+
+	for i := 0; i < 2; i++ {
+		if w := request(server, "/ifttt/gh/x", "192.0.2.1:1000", nil, "{}"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("unsigned request %d: %d", i + 1, w.Code)
+		}
+	}
+
+	// an unsupported content type stops the signed request right after the limits
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	header := http.Header{
+		"Content-Type":				{"application/xml"},
+		hmacDefaultTimestampHeader:	{ts},
+		hmacDefaultHeader:			{sign("secret", "POST", "/ifttt/gh/x", ts, "<x/>")},
+	}
+
+	if w := request(server, "/ifttt/gh/x", "198.51.100.1:1000", header, "<x/>"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("signed request: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLocationApiKey(t *testing.T) {
+	config := NewConfig()
+	server := &HttpServerData{config: config}
+
+	body := `{"who": "me", "area": "home", "type": "entered", "apiKey": "spoofed"}`
+
+	r := httptest.NewRequest("POST", "/ifttt/x", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentTypeJSON)
+
+	event, err := server.newEvent(config, r, "id", "192.168.1.10", &apiKey{name: "phone"}, "x", []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if location, ok := event.payload.(Location); !ok || location.ApiKey != "phone" || location.Area != "home" {
+		t.Errorf("payload = %+v", event.payload)
+	}
+}
+
+func TestBanNotResetByValidRequests(t *testing.T) {
+	key, _ := newAPIKey("low", "low-privilege-key")
+	key.dataIds = []string{"nothing"}
+
+	config := NewConfig()
+	config.apikeys		= []*apiKey{key}
+	config.maxFailures	= 3
+
+	server := newTestServer(config)
+
+	for i := 0; i < 10; i++ {
+		request(server, "/ifttt/guess-" + strconv.Itoa(i) + "/x", "192.0.2.1:1000", nil, "{}")
+
+		// valid, if forbidden for this data ID
+		request(server, "/ifttt/low-privilege-key/x", "192.0.2.1:1000", nil, "{}")
+	}
+
+	if banned, _ := server.dispatcher.bans.banned("192.0.2.1"); !banned {
+		t.Error("not banned")
+	}
+
+	if w := request(server, "/ifttt/low-privilege-key/x", "192.0.2.1:1000", nil, "{}"); w.Code != http.StatusForbidden || w.Header().Get("Retry-After") == "" {
+		t.Errorf("banned client: %d, Retry-After '%s'", w.Code, w.Header().Get("Retry-After"))
+	}
+}
+
+func TestSignedQuery(t *testing.T) {
+	key, _ := newAPIKey("gh", "unused")
+	key.hmac = newHmacConfig("secret")
+
+	config := NewConfig()
+	config.apikeys		= []*apiKey{key}
+	config.keySources	= []string{keySourceQuery}
+
+	server := newTestServer(config)
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	// signed as sent, with the key still in the query
+	header := http.Header{
+		hmacDefaultTimestampHeader:	{ts},
+		hmacDefaultHeader:			{sign("secret", "POST", "/ifttt/door?key=gh&state=open", ts, "")},
+	}
+
+	for _, path := range []string{"/ifttt/garage?key=gh&state=open", "/ifttt/door?key=gh&state=closed"} {
+		if w := request(server, path, "192.0.2.1:1000", header, ""); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: %d, want %d", path, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	if w := request(server, "/ifttt/door?key=gh&state=open", "192.0.2.1:1000", header, ""); w.Code == http.StatusUnauthorized {
+		t.Errorf("as signed: %d %s", w.Code, w.Body.String())
+	}
+}
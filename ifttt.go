@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"encoding/json"
+	"github.com/mikejac/log.golang"
+)
+
+//
+// MQTT messages matching a [trigger.<name>] topic fire an IFTTT Maker event, i.e.
+//
+//   POST https://maker.ifttt.com/trigger/<event>/with/key/<key>   {"value1": ..., "value2": ..., "value3": ...}
+//
+// value1..value3 are text/templates over the message; without any, value1 is the raw payload. All triggers
+// share one rate limited outboundWorker
+//
+
+const (
+	iftttDefaultUrl				string = "https://maker.ifttt.com"
+)
+
+type iftttTrigger struct {
+	name				string
+	topic				string					// MQTT topic filter
+	event				string					// IFTTT event name
+	key					string					// Maker key; the [ifttt] key if empty
+	values				[3]*template.Template	// value1..value3, nil if not set
+}
+
+type Ifttt struct {
+	baseUrl				string
+	key					string
+	worker				*outboundWorker
+}
+
+//
+//
+func NewIfttt(config *DispatcherConfiguration, deadLetter DeadLetterCallback) *Ifttt {
+	bucket := newTokenBucket(float64(config.iftttRate) / 60, config.iftttBurst)
+
+	return &Ifttt{
+		baseUrl:	strings.TrimSuffix(config.iftttUrl, "/"),
+		key:		config.iftttKey,
+		worker:		newOutboundWorker("ifttt", config.iftttTimeout, config.iftttRetries, bucket, deadLetter),
+	}
+}
+//
+//
+func (ifttt *Ifttt) Start() {
+	ifttt.worker.Start()
+}
+//
+//
+func (ifttt *Ifttt) Stop() {
+	ifttt.worker.Stop()
+}
+//
+// returns the MessageHandler for a trigger's subscription
+//
+func (ifttt *Ifttt) handler(trigger *iftttTrigger) MessageHandler {
+	return func(topic string, payload []byte) {
+		values, err := trigger.render(topic, payload)
+		if err != nil {
+			log.Infof("Ifttt::handler(): trigger '%s' on '%s'; %s", trigger.name, topic, err.Error())
+			return
+		}
+
+		body, err := json.Marshal(values)
+		if err != nil {
+			log.Infof("Ifttt::handler(): trigger '%s'; %s", trigger.name, err.Error())
+			return
+		}
+
+		key := trigger.key
+		if key == "" {
+			key = ifttt.key
+		}
+
+		ifttt.worker.enqueue(&outboundRequest{
+			rule:		"trigger." + trigger.name,
+			method:		http.MethodPost,
+			url:		ifttt.baseUrl + "/trigger/" + url.PathEscape(trigger.event) + "/with/key/" + url.PathEscape(key),
+			header:		http.Header{"Content-Type": {contentTypeJSON}},
+			body:		body,
+			topic:		topic,
+			payload:	payload,
+		})
+	}
+}
+//
+//
+func (trigger *iftttTrigger) render(topic string, payload []byte) (map[string]string, error) {
+	msg := newMqttMessage(topic, payload)
+
+	values := make(map[string]string)
+
+	for i, tmpl := range trigger.values {
+		if tmpl == nil {
+			continue
+		}
+
+		value, err := renderMessageTemplate(tmpl, msg)
+		if err != nil {
+			return nil, err
+		}
+
+		values[fmt.Sprintf("value%d", i + 1)] = value
+	}
+
+	if len(values) == 0 {
+		values["value1"] = msg.Raw
+	}
+
+	return values, nil
+}
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"encoding/json"
+)
+
+type makerRequest struct {
+	path				string
+	contentType			string
+	values				map[string]string
+}
+
+//
+// a Maker webhooks stand-in
+//
+func newMakerStandIn(t *testing.T) (*httptest.Server, chan makerRequest) {
+	requests := make(chan makerRequest, 10)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		m := makerRequest{path: r.URL.EscapedPath(), contentType: r.Header.Get("Content-Type")}
+		json.Unmarshal(body, &m.values)
+
+		requests <- m
+	}))
+	t.Cleanup(server.Close)
+
+	return server, requests
+}
+//
+//
+func newTestIfttt(t *testing.T, url string) *Ifttt {
+	config := NewConfig()
+	config.iftttUrl	= url + "/"
+	config.iftttKey	= "default-key"
+
+	ifttt := NewIfttt(config, nil)
+	ifttt.worker.backoff = time.Millisecond
+
+	ifttt.Start()
+	t.Cleanup(ifttt.Stop)
+
+	return ifttt
+}
+//
+//
+func receive(t *testing.T, requests chan makerRequest) makerRequest {
+	select {
+	case m := <- requests:
+		return m
+	case <- time.After(5 * time.Second):
+		t.Fatal("no request")
+	}
+
+	return makerRequest{}
+}
+
+func TestIftttTemplates(t *testing.T) {
+	server, requests := newMakerStandIn(t)
+	ifttt := newTestIfttt(t, server.URL)
+
+	trigger := &iftttTrigger{name: "door", topic: "home/+/door", event: "door opened", key: "trigger/key"}
+
+	var err error
+	if trigger.values[0], err = parseTemplate("value1", "{{ .Topic }}"); err != nil {
+		t.Fatal(err)
+	}
+	if trigger.values[2], err = parseTemplate("value3", "{{ .Payload.state | upper }}"); err != nil {
+		t.Fatal(err)
+	}
+
+	ifttt.handler(trigger)("home/hall/door", []byte(`{"state": "open"}`))
+
+	m := receive(t, requests)
+
+	if want := "/trigger/door%20opened/with/key/trigger%2Fkey"; m.path != want {
+		t.Errorf("path = %s, want %s", m.path, want)
+	}
+
+	if m.contentType != contentTypeJSON {
+		t.Errorf("content type = %s", m.contentType)
+	}
+
+	if len(m.values) != 2 || m.values["value1"] != "home/hall/door" || m.values["value3"] != "OPEN" {
+		t.Errorf("values = %v", m.values)
+	}
+}
+
+func TestIftttRawPayload(t *testing.T) {
+	server, requests := newMakerStandIn(t)
+	ifttt := newTestIfttt(t, server.URL)
+
+	ifttt.handler(&iftttTrigger{name: "raw", topic: "a/b", event: "raw"})("a/b", []byte("not json"))
+
+	m := receive(t, requests)
+
+	if m.path != "/trigger/raw/with/key/default-key" {
+		t.Errorf("path = %s", m.path)
+	}
+
+	if len(m.values) != 1 || m.values["value1"] != "not json" {
+		t.Errorf("values = %v", m.values)
+	}
+}
+
+func TestIftttMissingField(t *testing.T) {
+	server, requests := newMakerStandIn(t)
+	ifttt := newTestIfttt(t, server.URL)
+
+	trigger := &iftttTrigger{name: "missing", topic: "a/b", event: "missing"}
+	trigger.values[0], _ = parseTemplate("value1", "{{ .Payload.nope }}")
+
+	ifttt.handler(trigger)("a/b", []byte(`{"state": "open"}`))
+
+	select {
+	case m := <- requests:
+		t.Errorf("unexpected request %s", m.path)
+	case <- time.After(100 * time.Millisecond):
+	}
+}
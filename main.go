@@ -22,6 +22,7 @@
  package main
  
  import (
+	 "fmt"
 	 "time"
 	 "os"
 	 "github.com/docopt/docopt-go"
@@ -39,6 +40,7 @@
  
  Usage:
    iftt-mqtt-webhook <configfile> [--install] [--debug]
+   iftt-mqtt-webhook genkey <name> <configfile>
    iftt-mqtt-webhook (--start|--stop|--restart|--uninstall)
    iftt-mqtt-webhook -h | --help
    iftt-mqtt-webhook --version
@@ -57,6 +59,11 @@
 		 log.EnableDebugLog(true)
 	 }
  
+	 if arguments["genkey"].(bool) {
+		 genkey(arguments)
+		 return
+	 }
+ 
 	 /******************************************************************************************************************
 	  * prepare our service stuff
 	  *
@@ -130,6 +137,30 @@
 	 log.Flush()
  }
  
+ //
+ // prints a new API key and its hashed line for [apikeys]. The config file is only read for the pepper, but it
+ // is required: a key hashed without the pepper the service uses would never match
+ //
+ func genkey(arguments map[string]interface{}) {
+	 config := NewConfig()
+ 
+	 if err := config.ReadConfig(arguments["<configfile>"].(string)); err != nil {
+		 log.Infof("error: %s", err.Error())
+		 log.Flush()
+		 os.Exit(1)
+	 }
+ 
+	 key, hashed, err := generateAPIKey(config.pepper)
+	 if err != nil {
+		 log.Infof("error: %s", err.Error())
+		 log.Flush()
+		 os.Exit(1)
+	 }
+ 
+	 fmt.Printf("API key (give this to the sender, it isn't stored anywhere):\n\n    %s\n\n", key)
+	 fmt.Printf("for the [apikeys] section:\n\n    %s = %s\n", arguments["<name>"].(string), hashed)
+ }
+ 
  //
  //
  func (p *Program) run() {
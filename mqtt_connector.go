@@ -22,22 +22,26 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"io/ioutil"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 	"encoding/json"
 	"github.com/mikejac/log.golang"
-	MQTT "github.com/eclipse/paho.mqtt.golang"
 )
 
 //
 //
 type Mqtt struct {
-	// Paho MQTT
-	client					MQTT.Client
-	options  	 			*MQTT.ClientOptions
+	// MQTT client, either 3.1.1 or 5
+	transport				mqttTransport
 	qos 					byte
+	retain					bool
+	publishTimeout			time.Duration
 	
 	// MessageBus data
 	domain       			string
@@ -46,25 +50,103 @@ type Mqtt struct {
 	// other
 	statusInterval			int
 	startTime    			time.Time
+	tickerOnce				sync.Once			// the status ticker is started on the first Connect(), even if that fails
+
+	brokerMutex				sync.Mutex
+	activeBroker			string				// the broker we're connected to, if any
+
+	subscriptionMutex		sync.Mutex
+	subscriptions			[]*subscription		// renewed on every connect
+
+	nodeMutex				sync.Mutex
+	nodes					map[string]*msgbusNode	// the other nodes in our domain, see nodes.go
+	staleAfter				time.Duration
+
+	valueMutex				sync.Mutex
+	lastValues				map[string][]byte	// last update published per data ID, for msgbus Read requests
 
 	stateChangeCallback		StateChangeCallback
 	nodeChangeCallback		NodeChangeCallback
+	writeCallback			WriteCallback
+	rpcCallback				RPCCallback
+}
+
+type MessageHandler func(topic string, payload []byte)
+
+type subscription struct {
+	filter					string
+	qos						byte
+	handler					MessageHandler
+	inline					bool				// called in order on the client's goroutine; mustn't publish
+}
+
+//
+// mqttTransport hides the difference between the Paho 3.1.1 and MQTT 5 clients. Implementations report
+// connection changes through Mqtt.onConnect() and Mqtt.onDisconnect()
+//
+type mqttTransport interface {
+	Connect() error
+	Disconnect()
+	IsConnected() bool
+	Publish(topic string, qos byte, retained bool, payload []byte, props *PublishProperties, timeout time.Duration) (messageId uint16, err error)
+	Subscribe(filter string, qos byte) error
+}
+
+//
+// how a single update is published
+//
+type PublishOptions struct {
+	Topic					string				// empty for the msgbus layout
+	Qos						byte
+	Retain					bool
+	NoCache					bool				// not an update of the data ID, so not an answer to a msgbus Read
+	Properties				*PublishProperties
+}
+
+//
+// PublishProperties are only sent when using MQTT 5; the 3.1.1 client ignores them
+//
+type PublishProperties struct {
+	ContentType				string
+	MessageExpiry			uint32				// seconds, 0 for none
+	ResponseTopic			string
+	CorrelationData			[]byte
+	UserProperties			[]UserProperty
 }
 
+type UserProperty struct {
+	Key						string
+	Value					string
+}
+
+var errPublishTimeout = errors.New("timed out waiting for publish acknowledgement")
+
 type statusUpdate struct {
 	Status	string	`json:"status"`
 	Uptime	int64	`json:"uptime"`
 }
 
+const (
+	statusOnline	string = "online"
+	statusOffline	string = "offline"
+)
+
 //
 //
-func NewConnector(options *MqttOptions) (*Mqtt, error) {
-	mqtt := &Mqtt{}
+func NewConnector(options *MqttOptions) (mqtt *Mqtt, err error) {
+	mqtt = &Mqtt{}
 
-	mqtt.qos					= 1
+	mqtt.qos					= options.Qos
+	mqtt.retain					= options.Retain
+	mqtt.publishTimeout			= time.Duration(options.PublishTimeout) * time.Second
 	mqtt.stateChangeCallback	= options.StateChangeCallback
 	mqtt.nodeChangeCallback		= options.NodeChangeCallback
+	mqtt.writeCallback			= options.WriteCallback
+	mqtt.rpcCallback			= options.RPCCallback
+	mqtt.lastValues				= make(map[string][]byte)
 	mqtt.statusInterval			= options.StatusInterval
+	mqtt.staleAfter				= time.Duration(options.StaleAfter * options.StatusInterval) * time.Second
+	mqtt.nodes					= make(map[string]*msgbusNode)
 	mqtt.startTime				= time.Now()
 	mqtt.domain					= options.Domain
 	mqtt.nodename				= options.Nodename
@@ -78,90 +160,246 @@ func NewConnector(options *MqttOptions) (*Mqtt, error) {
 		clientId = options.ClientId
 	}
 	
-	opts := MQTT.NewClientOptions()
-	opts.AddBroker("tcp://" + options.Server + ":" + strconv.Itoa(options.Port))
-	opts.SetClientID(clientId)
-	opts.SetCleanSession(true)
-	opts.SetAutoReconnect(true)
-	opts.SetKeepAlive(time.Duration(options.Keepalive) * time.Second)
-	opts.SetDefaultPublishHandler(mqtt.onMessage)
-	opts.SetOnConnectHandler(mqtt.onConnect)
-	opts.SetConnectionLostHandler(mqtt.onDisconnect)
-
-	mqtt.options = opts
-	
-	if mqtt.client = MQTT.NewClient(mqtt.options); mqtt.client == nil {
-		return nil, errors.New("could not create Paho MQTT client")
+	// fail early rather than on every reconnect
+	if options.PasswordFile != "" {
+		if _, err := os.Stat(options.PasswordFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var tlsConfig *tls.Config
+
+	if options.brokerUsesTLS() {
+		if tlsConfig, err = newTLSConfig(options); err != nil {
+			return nil, err
+		}
+	}
+
+	switch options.ProtocolVersion {
+	case MqttProtocol311:
+		mqtt.transport, err = newTransport3(mqtt, options, clientId, tlsConfig)
+	case MqttProtocol5:
+		mqtt.transport, err = newTransport5(mqtt, options, clientId, tlsConfig)
+	default:
+		err = errors.New("unsupported MQTT protocol version " + strconv.Itoa(int(options.ProtocolVersion)))
 	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// requests addressed to us by other msgbus nodes
+	mqtt.Subscribe(mqtt.topicRequests(), mqtt.qos, mqtt.onRequest)
+
+	// presence of the other nodes; in order, or a reconnecting node's will and its new "online" could swap
+	mqtt.subscribe(&subscription{filter: mqtt.topicStatus(), qos: mqtt.qos, handler: mqtt.onStatus, inline: true})
 	
 	return mqtt, nil
 }
 //
 //
+func newTLSConfig(options *MqttOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:			options.ServerName,
+		InsecureSkipVerify:	options.InsecureSkipVerify,
+	}
+
+	if options.CaFile != "" {
+		pem, err := ioutil.ReadFile(options.CaFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in '" + options.CaFile + "'")
+		}
+	}
+
+	if options.CertFile != "" || options.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if options.InsecureSkipVerify {
+		log.Info("newTLSConfig(): server certificate verification is disabled")
+	}
+
+	return tlsConfig, nil
+}
+//
+//
 func (mqtt *Mqtt) Connect() error {
 	if mqtt == nil {
 		return errors.New("'mqtt' is nil")
 	}
 
-	if token := mqtt.client.Connect(); token.Wait() && token.Error() != nil {
-		return token.Error()
-	}
+	// the MQTT 5 transport keeps retrying in the background when the first attempt times out, so the ticker
+	// has to run regardless of how that went
+	mqtt.tickerOnce.Do(mqtt.startTicker)
 
+	return mqtt.transport.Connect()
+}
+//
+//
+func (mqtt *Mqtt) startTicker() {
 	ticker := time.NewTicker(time.Second * time.Duration(mqtt.statusInterval))
     go func() {
         for t := range ticker.C {
-			log.Debug("mqtt::Connect(): tick at ", t)
+			log.Debug("mqtt::startTicker(): tick at ", t)
 
-			status := statusUpdate{
-				Status:	"online",
-				Uptime:	time.Now().Unix() - mqtt.startTime.Unix(),
+			if mqtt.IsConnected() {
+				mqtt.publishStatus(statusOnline)
 			}
 
-			mqtt.PublishUpdate("Status", status)
+			mqtt.expireNodes()
         }
 	}()
-	
-	return nil
+}
+//
+//
+func (mqtt *Mqtt) IsConnected() bool {
+	return mqtt.transport.IsConnected()
+}
+//
+//
+func (mqtt *Mqtt) ActiveBroker() string {
+	mqtt.brokerMutex.Lock()
+	defer mqtt.brokerMutex.Unlock()
+
+	return mqtt.activeBroker
 }
 //
 //
 func (mqtt *Mqtt) Close() error {
 	log.Debugf("mqtt::Close(): begin")
 	
-	status := statusUpdate{
-		Status:	"offline",
-		Uptime:	time.Now().Unix() - mqtt.startTime.Unix(),
-	}
-
-	mqtt.PublishUpdate("Status", status)
+	// replaces the retained "online"; the will is only sent when the connection is lost
+	mqtt.publishStatus(statusOffline)
 	
-	mqtt.client.Disconnect(250)
+	mqtt.transport.Disconnect()
 	
 	log.Debugf("mqtt::Close(): end")
 
 	return nil
 }
 //
+// the message ID is only known for QoS > 0
 //
-func (mqtt *Mqtt) PublishUpdate(dataId string, data interface{}) error {
-	topic := mqtt.topicUpdate(dataId)
+func (mqtt *Mqtt) PublishUpdate(dataId string, data interface{}) (messageId uint16, err error) {
+	return mqtt.PublishUpdateWithOptions(dataId, data, &PublishOptions{Qos: mqtt.qos, Retain: mqtt.retain})
+}
+//
+//
+func (mqtt *Mqtt) PublishUpdateWithOptions(dataId string, data interface{}, opts *PublishOptions) (messageId uint16, err error) {
+	topic := opts.Topic
+	if topic == "" {
+		topic = mqtt.topicUpdate(dataId)
+	}
 
-	log.Debugf("mqtt::PublishUpdate(): topic = %s", topic)
+	log.Debugf("mqtt::PublishUpdate(): topic = %s, qos = %d, retain = %t", topic, opts.Qos, opts.Retain)
 	
 	b, err := json.Marshal(data)
 	if err != nil {
 		log.Info("mqtt::PublishUpdate(): marshal error = ", err)
-		return err
+		return 0, err
 	}
 
 	log.Debugf("mqtt::PublishUpdate(): b = %s", string(b[:]))
 	
-	if token := mqtt.client.Publish(topic, mqtt.qos, false, b); token.Wait() && token.Error() != nil {
-		log.Debugf("mqtt::PublishUpdate(): err = %s", token.Error().Error())
-		return token.Error()
+	if messageId, err = mqtt.transport.Publish(topic, opts.Qos, opts.Retain, b, opts.Properties, mqtt.publishTimeout); err != nil {
+		log.Debugf("mqtt::PublishUpdate(): err = %s", err.Error())
+		return 0, err
 	}
 
-	return nil
+	if !opts.NoCache {
+		mqtt.valueMutex.Lock()
+		mqtt.lastValues[dataId] = b
+		mqtt.valueMutex.Unlock()
+	}
+
+	return messageId, nil
+}
+//
+// the subscription is renewed every time we (re)connect
+//
+func (mqtt *Mqtt) Subscribe(filter string, qos byte, handler MessageHandler) error {
+	return mqtt.subscribe(&subscription{filter: filter, qos: qos, handler: handler})
+}
+//
+//
+func (mqtt *Mqtt) subscribe(sub *subscription) error {
+	log.Debugf("mqtt::subscribe(): filter = %s, inline = %t", sub.filter, sub.inline)
+
+	mqtt.subscriptionMutex.Lock()
+	mqtt.subscriptions = append(mqtt.subscriptions, sub)
+	mqtt.subscriptionMutex.Unlock()
+
+	if !mqtt.IsConnected() {
+		return nil
+	}
+
+	return mqtt.transport.Subscribe(sub.filter, sub.qos)
+}
+//
+//
+func (mqtt *Mqtt) resubscribe() {
+	mqtt.subscriptionMutex.Lock()
+	subscriptions := append([]*subscription(nil), mqtt.subscriptions...)
+	mqtt.subscriptionMutex.Unlock()
+
+	for _, sub := range subscriptions {
+		if err := mqtt.transport.Subscribe(sub.filter, sub.qos); err != nil {
+			log.Infof("mqtt::resubscribe(): failed to subscribe to '%s'; %s", sub.filter, err.Error())
+		}
+	}
+}
+//
+// status updates are retained so a node joining the domain immediately learns who is around
+//
+func (mqtt *Mqtt) publishStatus(status string) error {
+	b, err := json.Marshal(statusUpdate{Status: status, Uptime: time.Now().Unix() - mqtt.startTime.Unix()})
+	if err != nil {
+		return err
+	}
+
+	_, err = mqtt.transport.Publish(mqtt.topicUpdate(msgbusStatus), mqtt.qos, true, b, nil, mqtt.publishTimeout)
+
+	return err
+}
+//
+// publishes an empty retained message, which makes the broker drop the one retained on topic
+//
+func (mqtt *Mqtt) ClearRetained(topic string) error {
+	_, err := mqtt.transport.Publish(topic, mqtt.qos, true, []byte{}, nil, mqtt.publishTimeout)
+
+	return err
+}
+//
+// the Last Will and Testament, registered with the broker on every connect and published by it on our behalf
+// if the connection drops without a proper disconnect. The uptime isn't known at that point, so it's 0
+//
+func (mqtt *Mqtt) will() (topic string, payload []byte) {
+	payload, _ = json.Marshal(statusUpdate{Status: statusOffline})
+
+	return mqtt.topicUpdate(msgbusStatus), payload
+}
+//
+//
+func (mqtt *Mqtt) publish(topic string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = mqtt.transport.Publish(topic, mqtt.qos, false, b, nil, mqtt.publishTimeout)
+
+	return err
 }
 
 /******************************************************************************************************************
@@ -179,6 +417,9 @@ const (
 	msgbusWrite                 string = "Write"
 	msgbusRead                  string = "Read"
 	msgbusRPC                   string = "rpc"
+	msgbusReply                 string = "Reply"
+
+	msgbusStatus                string = "Status"
 )
 
 func (mqtt *Mqtt) topicUpdate(dataId string) string {
@@ -191,6 +432,29 @@ func (mqtt *Mqtt) topicUpdate(dataId string) string {
 
 	return topic
 }
+//
+// '<domain>/msgbus/v2/<dest>/<src>/'; dest is the node a message is addressed to, src the node sending it
+//
+func (mqtt *Mqtt) topicPrefix(dest string, src string) string {
+	return mqtt.domain + "/" + msgbusSelf + "/" + msgbusVersion + "/" + dest + "/" + src + "/"
+}
+//
+// matches '<dataId>.Write', '<dataId>.Read' and 'rpc' sent to us by any node
+//
+func (mqtt *Mqtt) topicRequests() string {
+	return mqtt.topicPrefix(mqtt.nodename, "+") + "+"
+}
+//
+// a reply to a Read request is an Update addressed to the node that asked
+//
+func (mqtt *Mqtt) topicReadReply(dest string, dataId string) string {
+	return mqtt.topicPrefix(dest, mqtt.nodename) + dataId + "." + msgbusUpdate
+}
+//
+//
+func (mqtt *Mqtt) topicRPCReply(dest string) string {
+	return mqtt.topicPrefix(dest, mqtt.nodename) + msgbusRPC + "." + msgbusReply
+}
 
 /******************************************************************************************************************
  * MQTT event handlers
@@ -199,28 +463,71 @@ func (mqtt *Mqtt) topicUpdate(dataId string) string {
 
 //
 //
-func (mqtt *Mqtt) onConnect(client MQTT.Client) {
-	log.Debugf("mqtt::onConnect()")
+func (mqtt *Mqtt) onConnect(broker string) {
+	mqtt.brokerMutex.Lock()
+	mqtt.activeBroker = broker
+	mqtt.brokerMutex.Unlock()
+
+	log.Debugf("mqtt::onConnect(): broker = '%s'", broker)
+
+	// the session is clean, so nothing is remembered from last time
+	mqtt.resubscribe()
+
+	// overwrites the will, should the broker have published it after we lost the previous connection
+	if err := mqtt.publishStatus(statusOnline); err != nil {
+		log.Infof("mqtt::onConnect(): failed to publish status; %s", err.Error())
+	}
 
 	if mqtt.stateChangeCallback != nil {
-		mqtt.stateChangeCallback(true)
+		mqtt.stateChangeCallback(true, broker)
 	}
 }
 //
 //
-func (mqtt *Mqtt) onDisconnect(client MQTT.Client, err error) {
-	log.Debugf("mqtt::onDisonnect()")
+func (mqtt *Mqtt) onDisconnect() {
+	mqtt.brokerMutex.Lock()
+	broker := mqtt.activeBroker
+	mqtt.activeBroker = ""
+	mqtt.brokerMutex.Unlock()
+
+	log.Debugf("mqtt::onDisonnect(): broker = '%s'", broker)
 	
 	if mqtt.stateChangeCallback != nil {
-		mqtt.stateChangeCallback(false)
+		mqtt.stateChangeCallback(false, broker)
+	}
+}
+//
+// handlers run in their own goroutine since they may well publish something, which would deadlock the client
+// if done from within its callback. Inline subscriptions are the exception; they need their messages in order
+//
+func (mqtt *Mqtt) onMessage(topic string, payload []byte) {
+	log.Debugf("mqtt::onMessage(): topic = %s", topic)
+
+	// not under the mutex, so a handler may subscribe
+	mqtt.subscriptionMutex.Lock()
+	subscriptions := append([]*subscription(nil), mqtt.subscriptions...)
+	mqtt.subscriptionMutex.Unlock()
+
+	for _, sub := range subscriptions {
+		if !topicMatches(sub.filter, topic) {
+			continue
+		}
+
+		if sub.inline {
+			deliver(sub.handler, topic, payload)
+		} else {
+			go deliver(sub.handler, topic, payload)
+		}
 	}
 }
-func (mqtt *Mqtt) onMessage(client MQTT.Client, msg MQTT.Message) {
+//
+//
+func deliver(handler MessageHandler, topic string, payload []byte) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Info("mqtt::onMessage(): panic recovered; ", r)
 		}
 	}()
 
-	log.Debugf("mqtt::onMessage()")
+	handler(topic, payload)
 }
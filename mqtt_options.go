@@ -22,25 +22,89 @@
  package main
  
  import (
+	 "errors"
+	 "encoding/json"
+	 "os"
+	 "strconv"
+	 "strings"
+	 "io/ioutil"
+	 "net/http"
+	 "net/url"
+	 "github.com/mikejac/log.golang"
 	 "github.com/twinj/uuid"
  )
  
 type MsgbusStatus int
 
+const (
+	MsgbusStatusOffline		MsgbusStatus = iota		// the node said goodbye
+	MsgbusStatusOnline								// the node is sending status updates
+	MsgbusStatusStale								// the node has missed too many status updates
+)
+
+//
+//
+func (s MsgbusStatus) String() string {
+	switch s {
+	case MsgbusStatusOffline:
+		return "offline"
+	case MsgbusStatusOnline:
+		return "online"
+	case MsgbusStatusStale:
+		return "stale"
+	}
+
+	return "unknown"
+}
+
+const (
+	MqttProtocol311		uint = 4				// MQTT 3.1.1
+	MqttProtocol5		uint = 5				// MQTT 5
+)
+
 //
 //
 type MqttOptions struct {
 	Server 				string					// name or ip of the MQTT server
 	Port 				int						// portnumber of the MQTT server (usually 1883)
+	Url					string					// full broker URL (tcp, ssl, ws or wss); replaces Server and Port
+	Brokers				[]string				// ordered list of broker URLs, tried in turn; replaces all of the above
+	HTTPHeaders			http.Header				// extra headers for the WebSocket upgrade request
 	ClientId			string					// MQTT client id
+	ProtocolVersion		uint					// MqttProtocol311 or MqttProtocol5
 	Keepalive 			int						// MQTT keep-alive interval in seconds
+	PublishTimeout		int						// seconds to wait for a publish to be acknowledged
+	Qos					byte					// default QoS for publishing and subscribing
+	Retain				bool					// default retain flag for updates
+
+	UseTLS				bool					// connect using ssl:// instead of tcp://
+	CaFile				string					// PEM bundle used to verify the server; system roots if empty
+	CertFile			string					// client certificate for mutual TLS
+	KeyFile				string					// key for the client certificate
+	ServerName			string					// overrides the name the server certificate is checked against
+	InsecureSkipVerify	bool					// don't verify the server certificate (lab setups only)
+
+	Username			string					// MQTT username; empty for anonymous brokers
+	Password			string					// MQTT password or access token
+	PasswordFile		string					// read the password from this file on every connect; takes precedence
+	PasswordEnv			string					// read the password from this environment variable on every connect
+
+	CredentialsProvider	CredentialsProvider		// replaces the settings above, called before every (re)connect
+
+	// MQTT 5 only
+	ContentType			string					// content type of published updates
+	MessageExpiry		uint32					// seconds before the broker discards an undelivered update, 0 for never
+	ResponseTopic		string					// response topic added to published updates
 
 	Domain 		    	string					// Very first part of all MQTT topics
 	Nodename 			string					// Our nodename
 	StatusInterval		int
+	StaleAfter			int						// a node missing this many status intervals is considered stale
 
 	StateChangeCallback	StateChangeCallback
 	NodeChangeCallback	NodeChangeCallback
+	WriteCallback		WriteCallback			// msgbus Write requests
+	RPCCallback			RPCCallback				// msgbus rpc requests
 }
 
 //
@@ -50,10 +114,15 @@ func NewMqttOptions() *MqttOptions {
 		Server:			"localhost",
 		Port:			1883,
 		ClientId:		"",
+		ProtocolVersion:	MqttProtocol311,
 		Keepalive:		60,
+		PublishTimeout:	10,
+		Qos:			1,
+		ContentType:	"application/json",
 		Domain:			"domain",
 		Nodename:		uuid.NewV4().String(),
 		StatusInterval:	60,
+		StaleAfter:		3,
 	}
 
 	return o
@@ -71,18 +140,225 @@ func (o *MqttOptions) SetPort(port int) (*MqttOptions) {
 	return o
 }
  
+//
+func (o *MqttOptions) SetUrl(url string) (*MqttOptions) {
+	o.Url = url
+	return o
+}
+ 
+//
+func (o *MqttOptions) AddBroker(url string) (*MqttOptions) {
+	o.Brokers = append(o.Brokers, url)
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetHTTPHeader(name string, value string) (*MqttOptions) {
+	if o.HTTPHeaders == nil {
+		o.HTTPHeaders = make(http.Header)
+	}
+
+	o.HTTPHeaders.Add(name, value)
+	return o
+}
+
+//
+// in order of preference
+//
+func (o *MqttOptions) brokerURLs() ([]string, error) {
+	brokers := o.Brokers
+
+	if len(brokers) == 0 && o.Url != "" {
+		brokers = []string{o.Url}
+	}
+
+	if len(brokers) == 0 {
+		if o.UseTLS {
+			return []string{"ssl://" + o.Server + ":" + strconv.Itoa(o.Port)}, nil
+		}
+
+		return []string{"tcp://" + o.Server + ":" + strconv.Itoa(o.Port)}, nil
+	}
+
+	for _, broker := range brokers {
+		u, err := url.Parse(broker)
+		if err != nil {
+			return nil, err
+		}
+
+		switch u.Scheme {
+		case "tcp", "ssl", "ws", "wss":
+		default:
+			return nil, errors.New("unsupported broker URL scheme '" + u.Scheme + "'")
+		}
+	}
+
+	return brokers, nil
+}
+
+//
+func (o *MqttOptions) brokerUsesTLS() bool {
+	brokers, _ := o.brokerURLs()
+
+	for _, broker := range brokers {
+		if strings.HasPrefix(broker, "ssl://") || strings.HasPrefix(broker, "wss://") {
+			return true
+		}
+	}
+
+	return false
+}
+ 
 //
 func (o *MqttOptions) SetClientId(clientId string) (*MqttOptions) {
 	o.ClientId = clientId
 	return o
 }
  
+//
+func (o *MqttOptions) SetProtocolVersion(version uint) (*MqttOptions) {
+	o.ProtocolVersion = version
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetContentType(contentType string) (*MqttOptions) {
+	o.ContentType = contentType
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetMessageExpiry(expiry uint32) (*MqttOptions) {
+	o.MessageExpiry = expiry
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetResponseTopic(topic string) (*MqttOptions) {
+	o.ResponseTopic = topic
+	return o
+}
+ 
 //
 func (o *MqttOptions) SetKeepalive(keepalive int) (*MqttOptions) {
 	o.Keepalive = keepalive
 	return o
 }
  
+//
+func (o *MqttOptions) SetPublishTimeout(timeout int) (*MqttOptions) {
+	o.PublishTimeout = timeout
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetQos(qos byte) (*MqttOptions) {
+	o.Qos = qos
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetRetain(retain bool) (*MqttOptions) {
+	o.Retain = retain
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetUseTLS(useTLS bool) (*MqttOptions) {
+	o.UseTLS = useTLS
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetCaFile(caFile string) (*MqttOptions) {
+	o.CaFile = caFile
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetClientCertificate(certFile string, keyFile string) (*MqttOptions) {
+	o.CertFile = certFile
+	o.KeyFile  = keyFile
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetServerName(serverName string) (*MqttOptions) {
+	o.ServerName = serverName
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetInsecureSkipVerify(insecure bool) (*MqttOptions) {
+	o.InsecureSkipVerify = insecure
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetUsername(username string) (*MqttOptions) {
+	o.Username = username
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetPassword(password string) (*MqttOptions) {
+	o.Password = password
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetPasswordFile(passwordFile string) (*MqttOptions) {
+	o.PasswordFile = passwordFile
+	return o
+}
+ 
+//
+func (o *MqttOptions) SetPasswordEnv(passwordEnv string) (*MqttOptions) {
+	o.PasswordEnv = passwordEnv
+	return o
+}
+ 
+type CredentialsProvider func() (username string, password string)
+
+//
+func (o *MqttOptions) SetCredentialsProvider(fn CredentialsProvider) (*MqttOptions) {
+	o.CredentialsProvider = fn
+	return o
+}
+
+//
+func (o *MqttOptions) hasCredentials() bool {
+	return o.CredentialsProvider != nil || o.Username != "" || o.Password != "" || o.PasswordFile != "" || o.PasswordEnv != ""
+}
+
+//
+// the file and the environment are read on every call so a rotated password or token is picked up on the
+// next reconnect. If the file can't be read the previous sources are used
+//
+func (o *MqttOptions) credentials() (username string, password string) {
+	if o.CredentialsProvider != nil {
+		return o.CredentialsProvider()
+	}
+
+	password = o.Password
+
+	if o.PasswordEnv != "" {
+		if v, ok := os.LookupEnv(o.PasswordEnv); ok {
+			password = v
+		}
+	}
+
+	if o.PasswordFile != "" {
+		if b, err := ioutil.ReadFile(o.PasswordFile); err != nil {
+			log.Infof("MqttOptions::credentials(): %s", err.Error())
+		} else {
+			password = strings.TrimRight(string(b), "\r\n")
+		}
+	}
+
+	return o.Username, password
+}
+ 
 //
 func (o *MqttOptions) SetDomain(domain string) (*MqttOptions) {
 	o.Domain = domain
@@ -95,13 +371,20 @@ func (o *MqttOptions) SetStatusInterval(interval int) (*MqttOptions) {
 	return o
 }
 
+//
+func (o *MqttOptions) SetStaleAfter(intervals int) (*MqttOptions) {
+	o.StaleAfter = intervals
+	return o
+}
+
 //
 func (o *MqttOptions) SetNodename(nodename string) (*MqttOptions) {
 	o.Nodename = nodename
 	return o
 }
  
-type StateChangeCallback func(connected bool)
+// broker is the URL of the broker that was connected to or lost
+type StateChangeCallback func(connected bool, broker string)
 
 //
 func (o *MqttOptions) SetStateChangeCallback(fn StateChangeCallback) (*MqttOptions) {
@@ -109,6 +392,8 @@ func (o *MqttOptions) SetStateChangeCallback(fn StateChangeCallback) (*MqttOptio
 	return o
 }
  
+// called when another msgbus node comes online, goes offline or turns stale. Changes are reported in the order
+// they arrive, from the MQTT client's goroutine, so the callback mustn't wait for a publish to complete
 type NodeChangeCallback func(nodename string, status MsgbusStatus, uptime int64)
  
 //
@@ -116,3 +401,21 @@ func (o *MqttOptions) SetNodeChangeCallback(fn NodeChangeCallback) (*MqttOptions
 	o.NodeChangeCallback = fn
 	return o
 }
+
+// src is the node that sent the request
+type WriteCallback func(src string, dataId string, value json.RawMessage) error
+
+//
+func (o *MqttOptions) SetWriteCallback(fn WriteCallback) (*MqttOptions) {
+	o.WriteCallback = fn
+	return o
+}
+
+// the result is sent back to src as JSON
+type RPCCallback func(src string, method string, params json.RawMessage) (result interface{}, err error)
+
+//
+func (o *MqttOptions) SetRPCCallback(fn RPCCallback) (*MqttOptions) {
+	o.RPCCallback = fn
+	return o
+}
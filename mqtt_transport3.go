@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+	"github.com/mikejac/log.golang"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const (
+	transport3ConnectTimeout	= 10 * time.Second		// how long Connect() waits for the first attempt
+	transport3RetryInterval		= 10 * time.Second
+)
+
+var errStillConnecting = errors.New("not connected yet, retrying in the background")
+
+//
+// MQTT 3.1.1 using the Paho client
+//
+type mqttTransport3 struct {
+	mqtt					*Mqtt
+	client					MQTT.Client
+
+	brokerMutex				sync.Mutex
+	attemptedBroker			string				// the broker paho is currently trying
+}
+
+//
+//
+func newTransport3(mqtt *Mqtt, options *MqttOptions, clientId string, tlsConfig *tls.Config) (t *mqttTransport3, err error) {
+	t = &mqttTransport3{mqtt: mqtt}
+
+	brokers, err := options.brokerURLs()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := MQTT.NewClientOptions()
+
+	// paho tries the brokers in this order on every (re)connect, so we fall back to the primary once it's back
+	for _, broker := range brokers {
+		log.Debugf("newTransport3(): broker = '%s'", broker)
+		opts.AddBroker(broker)
+	}
+
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	if len(options.HTTPHeaders) > 0 {
+		opts.SetHTTPHeaders(options.HTTPHeaders)
+	}
+
+	if options.hasCredentials() {
+		opts.SetCredentialsProvider(MQTT.CredentialsProvider(options.credentials))
+	}
+
+	willTopic, willPayload := mqtt.will()
+	opts.SetBinaryWill(willTopic, willPayload, mqtt.qos, true)
+
+	opts.SetClientID(clientId)
+	opts.SetCleanSession(true)
+	opts.SetAutoReconnect(true)
+	// auto reconnect only kicks in once a connection has been made; this covers a broker that's down at startup
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(transport3RetryInterval)
+	opts.SetKeepAlive(time.Duration(options.Keepalive) * time.Second)
+	opts.SetDefaultPublishHandler(t.onMessage)
+	opts.SetOnConnectHandler(t.onConnect)
+	opts.SetConnectionLostHandler(t.onDisconnect)
+	opts.SetConnectionAttemptHandler(t.onConnectAttempt)
+
+	if t.client = MQTT.NewClient(opts); t.client == nil {
+		return nil, errors.New("could not create Paho MQTT client")
+	}
+
+	return t, nil
+}
+//
+// with connect retry the token isn't done until a connection is made, so don't wait for it forever; paho
+// keeps trying and onConnect() tells when it worked
+//
+func (t *mqttTransport3) Connect() error {
+	token := t.client.Connect()
+
+	if !token.WaitTimeout(transport3ConnectTimeout) {
+		return errStillConnecting
+	}
+
+	return token.Error()
+}
+//
+//
+func (t *mqttTransport3) Disconnect() {
+	t.client.Disconnect(250)
+}
+//
+//
+func (t *mqttTransport3) IsConnected() bool {
+	// IsConnected() is also true while the client is reconnecting
+	return t.client.IsConnectionOpen()
+}
+//
+// props are MQTT 5 only and are ignored
+//
+func (t *mqttTransport3) Publish(topic string, qos byte, retained bool, payload []byte, props *PublishProperties, timeout time.Duration) (messageId uint16, err error) {
+	token := t.client.Publish(topic, qos, retained, payload)
+
+	if !token.WaitTimeout(timeout) {
+		return 0, errPublishTimeout
+	}
+
+	if token.Error() != nil {
+		return 0, token.Error()
+	}
+
+	if pt, ok := token.(*MQTT.PublishToken); ok {
+		messageId = pt.MessageID()
+	}
+
+	return messageId, nil
+}
+
+//
+// messages arrive through the default publish handler
+//
+func (t *mqttTransport3) Subscribe(filter string, qos byte) error {
+	if token := t.client.Subscribe(filter, qos, nil); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+
+	return nil
+}
+
+/******************************************************************************************************************
+ * Paho event handlers
+ *
+ */
+
+//
+//
+func (t *mqttTransport3) onConnect(client MQTT.Client) {
+	t.brokerMutex.Lock()
+	broker := t.attemptedBroker
+	t.brokerMutex.Unlock()
+
+	t.mqtt.onConnect(broker)
+}
+//
+//
+func (t *mqttTransport3) onDisconnect(client MQTT.Client, err error) {
+	log.Debugf("mqttTransport3::onDisconnect(): err = %v", err)
+
+	t.mqtt.onDisconnect()
+}
+//
+// called by paho for every broker it tries; the last one before onConnect() is the one we're connected to
+//
+func (t *mqttTransport3) onConnectAttempt(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
+	log.Debugf("mqttTransport3::onConnectAttempt(): broker = '%s'", broker.Redacted())
+
+	t.brokerMutex.Lock()
+	t.attemptedBroker = broker.Redacted()
+	t.brokerMutex.Unlock()
+
+	return tlsCfg
+}
+//
+//
+func (t *mqttTransport3) onMessage(client MQTT.Client, msg MQTT.Message) {
+	t.mqtt.onMessage(msg.Topic(), msg.Payload())
+}
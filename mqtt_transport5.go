@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/mikejac/log.golang"
+)
+
+const transport5ConnectTimeout = 10 * time.Second
+
+//
+// MQTT 5 using the Paho autopaho connection manager
+//
+type mqttTransport5 struct {
+	mqtt					*Mqtt
+	config					autopaho.ClientConfig
+	options					*MqttOptions
+
+	ctx						context.Context
+	cancel					context.CancelFunc
+
+	mutex					sync.Mutex
+	cm						*autopaho.ConnectionManager
+	connected				bool
+	attemptedBroker			string
+}
+
+//
+//
+func newTransport5(mqtt *Mqtt, options *MqttOptions, clientId string, tlsConfig *tls.Config) (t *mqttTransport5, err error) {
+	t = &mqttTransport5{mqtt: mqtt, options: options}
+
+	brokers, err := options.brokerURLs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, broker := range brokers {
+		log.Debugf("newTransport5(): broker = '%s'", broker)
+
+		u, err := url.Parse(broker)
+		if err != nil {
+			return nil, err
+		}
+
+		t.config.ServerUrls = append(t.config.ServerUrls, u)
+	}
+
+	t.config.TlsCfg							= tlsConfig
+	t.config.KeepAlive						= uint16(options.Keepalive)
+	t.config.CleanStartOnInitialConnection	= true
+	t.config.ConnectTimeout					= transport5ConnectTimeout
+	t.config.ConnectPacketBuilder			= t.buildConnectPacket
+	t.config.OnConnectionUp					= t.onConnectionUp
+	t.config.OnConnectionDown				= t.onConnectionDown
+	t.config.OnConnectError					= t.onConnectError
+	t.config.ClientID						= clientId
+
+	willTopic, willPayload := mqtt.will()
+
+	t.config.WillMessage = &paho.WillMessage{
+		Retain:		true,
+		QoS:		mqtt.qos,
+		Topic:		willTopic,
+		Payload:	willPayload,
+	}
+	t.config.OnPublishReceived				= []func(paho.PublishReceived) (bool, error){t.onPublishReceived}
+
+	if len(options.HTTPHeaders) > 0 {
+		t.config.WebSocketCfg = &autopaho.WebSocketConfig{
+			Header: func(u *url.URL, tlsCfg *tls.Config) http.Header {
+				return options.HTTPHeaders
+			},
+		}
+	}
+
+	return t, nil
+}
+//
+// unlike the 3.1.1 client, autopaho keeps retrying in the background when the first attempt fails
+//
+func (t *mqttTransport5) Connect() (err error) {
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+
+	cm, err := autopaho.NewConnection(t.ctx, t.config)
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	t.cm = cm
+	t.mutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(t.ctx, transport5ConnectTimeout)
+	defer cancel()
+
+	return cm.AwaitConnection(ctx)
+}
+//
+//
+func (t *mqttTransport5) Disconnect() {
+	cm := t.connectionManager()
+	if cm == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250 * time.Millisecond)
+	defer cancel()
+
+	cm.Disconnect(ctx)
+	t.cancel()
+}
+//
+//
+func (t *mqttTransport5) IsConnected() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.connected
+}
+//
+// the MQTT 5 client doesn't expose the packet identifier, so messageId is always 0
+//
+func (t *mqttTransport5) Publish(topic string, qos byte, retained bool, payload []byte, props *PublishProperties, timeout time.Duration) (messageId uint16, err error) {
+	cm := t.connectionManager()
+	if cm == nil {
+		return 0, autopaho.ConnectionDownError
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, err = cm.Publish(ctx, &paho.Publish{
+		QoS:		qos,
+		Retain:		retained,
+		Topic:		topic,
+		Payload:	payload,
+		Properties:	newPahoPublishProperties(props),
+	})
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 0, errPublishTimeout
+	}
+
+	return 0, err
+}
+//
+// messages arrive through onPublishReceived()
+//
+func (t *mqttTransport5) Subscribe(filter string, qos byte) error {
+	cm := t.connectionManager()
+	if cm == nil {
+		return autopaho.ConnectionDownError
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), transport5ConnectTimeout)
+	defer cancel()
+
+	_, err := cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{
+			{Topic: filter, QoS: qos},
+		},
+	})
+
+	return err
+}
+//
+//
+func (t *mqttTransport5) connectionManager() *autopaho.ConnectionManager {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.cm
+}
+//
+//
+func newPahoPublishProperties(props *PublishProperties) *paho.PublishProperties {
+	if props == nil {
+		return nil
+	}
+
+	p := &paho.PublishProperties{
+		ContentType:		props.ContentType,
+		ResponseTopic:		props.ResponseTopic,
+		CorrelationData:	props.CorrelationData,
+	}
+
+	if props.MessageExpiry > 0 {
+		expiry := props.MessageExpiry
+		p.MessageExpiry = &expiry
+	}
+
+	for _, u := range props.UserProperties {
+		p.User.Add(u.Key, u.Value)
+	}
+
+	return p
+}
+
+/******************************************************************************************************************
+ * autopaho event handlers
+ *
+ */
+
+//
+// called before every connection attempt, so credentials are fetched again on each reconnect
+//
+func (t *mqttTransport5) buildConnectPacket(cp *paho.Connect, broker *url.URL) (*paho.Connect, error) {
+	log.Debugf("mqttTransport5::buildConnectPacket(): broker = '%s'", broker.Redacted())
+
+	t.mutex.Lock()
+	t.attemptedBroker = broker.Redacted()
+	t.mutex.Unlock()
+
+	if t.options.hasCredentials() {
+		username, password := t.options.credentials()
+
+		cp.Username		= username
+		cp.UsernameFlag	= username != ""
+		cp.Password		= []byte(password)
+		cp.PasswordFlag	= password != ""
+	}
+
+	return cp, nil
+}
+//
+//
+func (t *mqttTransport5) onConnectionUp(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+	t.mutex.Lock()
+	t.connected = true
+	broker := t.attemptedBroker
+	t.mutex.Unlock()
+
+	// autopaho wants this to return quickly
+	go t.mqtt.onConnect(broker)
+}
+//
+//
+func (t *mqttTransport5) onConnectionDown() bool {
+	t.mutex.Lock()
+	t.connected = false
+	t.mutex.Unlock()
+
+	go t.mqtt.onDisconnect()
+
+	// keep trying
+	return true
+}
+//
+//
+func (t *mqttTransport5) onConnectError(err error) {
+	log.Debugf("mqttTransport5::onConnectError(): err = %s", err.Error())
+}
+//
+//
+func (t *mqttTransport5) onPublishReceived(pr paho.PublishReceived) (bool, error) {
+	t.mqtt.onMessage(pr.Packet.Topic, pr.Packet.Payload)
+
+	return true, nil
+}
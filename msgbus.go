@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"errors"
+	"strings"
+	"encoding/json"
+	"github.com/mikejac/log.golang"
+)
+
+//
+// msgbus requests are addressed to '<domain>/msgbus/v2/<our nodename>/<src>/...':
+//
+//   <dataId>.Write   the payload is the new value of the setting named by dataId
+//   <dataId>.Read    answered with the last Update we published for dataId, sent to '.../<src>/<us>/<dataId>.Update'
+//   rpc              {"id": ..., "method": "...", "params": ...}, answered on '.../<src>/<us>/rpc.Reply'
+//
+
+type rpcRequest struct {
+	Id						json.RawMessage	`json:"id,omitempty"`
+	Method					string			`json:"method"`
+	Params					json.RawMessage	`json:"params,omitempty"`
+}
+
+type rpcReply struct {
+	Id						json.RawMessage	`json:"id,omitempty"`
+	Result					interface{}		`json:"result,omitempty"`
+	Error					string			`json:"error,omitempty"`
+}
+
+var errNoHandler = errors.New("not supported by this node")
+
+//
+//
+func (mqtt *Mqtt) onRequest(topic string, payload []byte) {
+	// topicPrefix() with an empty source ends in '//', so drop the last slash to get '<domain>/msgbus/v2/<us>/'
+	f := strings.Split(strings.TrimPrefix(topic, strings.TrimSuffix(mqtt.topicPrefix(mqtt.nodename, ""), "/")), "/")
+	if len(f) != 2 {
+		log.Infof("mqtt::onRequest(): malformed topic '%s'", topic)
+		return
+	}
+
+	src, request := f[0], f[1]
+
+	log.Debugf("mqtt::onRequest(): src = '%s', request = '%s'", src, request)
+
+	switch {
+	case request == msgbusRPC:
+		mqtt.onRPC(src, payload)
+
+	case strings.HasSuffix(request, "." + msgbusRead):
+		mqtt.onRead(src, strings.TrimSuffix(request, "." + msgbusRead))
+
+	case strings.HasSuffix(request, "." + msgbusWrite):
+		mqtt.onWrite(src, strings.TrimSuffix(request, "." + msgbusWrite), payload)
+
+	default:
+		log.Debugf("mqtt::onRequest(): ignoring '%s'", topic)
+	}
+}
+//
+//
+func (mqtt *Mqtt) onRead(src string, dataId string) {
+	mqtt.valueMutex.Lock()
+	value, ok := mqtt.lastValues[dataId]
+	mqtt.valueMutex.Unlock()
+
+	if !ok {
+		log.Infof("mqtt::onRead(): '%s' asked for '%s' which hasn't been published", src, dataId)
+		return
+	}
+
+	if err := mqtt.publish(mqtt.topicReadReply(src, dataId), json.RawMessage(value)); err != nil {
+		log.Infof("mqtt::onRead(): reply to '%s' failed; %s", src, err.Error())
+	}
+}
+//
+//
+func (mqtt *Mqtt) onWrite(src string, dataId string, payload []byte) {
+	if mqtt.writeCallback == nil {
+		log.Infof("mqtt::onWrite(): '%s' tried to write '%s'; %s", src, dataId, errNoHandler.Error())
+		return
+	}
+
+	if !json.Valid(payload) {
+		log.Infof("mqtt::onWrite(): '%s' sent an invalid value for '%s'", src, dataId)
+		return
+	}
+
+	if err := mqtt.writeCallback(src, dataId, json.RawMessage(payload)); err != nil {
+		log.Infof("mqtt::onWrite(): '%s' failed to write '%s'; %s", src, dataId, err.Error())
+	}
+}
+//
+//
+func (mqtt *Mqtt) onRPC(src string, payload []byte) {
+	var request rpcRequest
+	var reply   rpcReply
+
+	if err := json.Unmarshal(payload, &request); err != nil {
+		reply.Error = "malformed request; " + err.Error()
+	} else {
+		reply.Id = request.Id
+
+		if mqtt.rpcCallback == nil {
+			reply.Error = errNoHandler.Error()
+		} else if result, err := mqtt.rpcCallback(src, request.Method, request.Params); err != nil {
+			reply.Error = err.Error()
+		} else {
+			reply.Result = result
+		}
+	}
+
+	if err := mqtt.publish(mqtt.topicRPCReply(src), reply); err != nil {
+		log.Infof("mqtt::onRPC(): reply to '%s' failed; %s", src, err.Error())
+	}
+}
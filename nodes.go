@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"encoding/json"
+	"github.com/mikejac/log.golang"
+)
+
+//
+// every node broadcasts '<domain>/msgbus/v2/broadcast/<node>/Status.Update' each status interval; these
+// are used to keep a table of the other nodes in the domain
+//
+
+type msgbusNode struct {
+	status					MsgbusStatus
+	uptime					int64
+	lastSeen				time.Time
+}
+
+// a snapshot of one entry in the node table, see Mqtt.Nodes()
+type MsgbusNode struct {
+	Nodename				string			`json:"nodename"`
+	Status					string			`json:"status"`
+	Uptime					int64			`json:"uptime"`
+	LastSeen				int64			`json:"last_seen"`
+}
+
+type nodeChange struct {
+	nodename				string
+	status					MsgbusStatus
+	uptime					int64
+}
+
+//
+// status updates from all nodes, including ourselves
+//
+func (mqtt *Mqtt) topicStatus() string {
+	return mqtt.topicPrefix(msgbusDestBroadcast, "+") + msgbusStatus + "." + msgbusUpdate
+}
+//
+//
+func (mqtt *Mqtt) onStatus(topic string, payload []byte) {
+	nodename := strings.Split(strings.TrimPrefix(topic, strings.TrimSuffix(mqtt.topicPrefix(msgbusDestBroadcast, ""), "/")), "/")[0]
+
+	if nodename == "" || nodename == mqtt.nodename {
+		return
+	}
+
+	var update statusUpdate
+
+	if err := json.Unmarshal(payload, &update); err != nil {
+		log.Infof("mqtt::onStatus(): invalid status from '%s'; %s", nodename, err.Error())
+		return
+	}
+
+	status := MsgbusStatusOnline
+	if update.Status == statusOffline {
+		status = MsgbusStatusOffline
+	}
+
+	mqtt.nodeMutex.Lock()
+
+	node, known := mqtt.nodes[nodename]
+	if !known {
+		node = &msgbusNode{}
+		mqtt.nodes[nodename] = node
+	}
+
+	changed := !known || node.status != status
+
+	node.status		= status
+	node.uptime		= update.Uptime
+	node.lastSeen	= time.Now()
+
+	mqtt.nodeMutex.Unlock()
+
+	log.Debugf("mqtt::onStatus(): node = '%s', status = %s, uptime = %d", nodename, status, update.Uptime)
+
+	if changed {
+		mqtt.notifyNodeChanges([]nodeChange{{nodename: nodename, status: status, uptime: update.Uptime}})
+	}
+}
+//
+// called every status interval; online nodes we haven't heard from for StaleAfter intervals are marked stale
+//
+func (mqtt *Mqtt) expireNodes() {
+	if mqtt.staleAfter <= 0 {
+		return
+	}
+
+	var changes []nodeChange
+
+	mqtt.nodeMutex.Lock()
+
+	for nodename, node := range mqtt.nodes {
+		if node.status == MsgbusStatusOnline && time.Since(node.lastSeen) > mqtt.staleAfter {
+			node.status = MsgbusStatusStale
+			changes = append(changes, nodeChange{nodename: nodename, status: node.status, uptime: node.uptime})
+		}
+	}
+
+	mqtt.nodeMutex.Unlock()
+
+	mqtt.notifyNodeChanges(changes)
+}
+//
+//
+func (mqtt *Mqtt) notifyNodeChanges(changes []nodeChange) {
+	if mqtt.nodeChangeCallback == nil {
+		return
+	}
+
+	for _, change := range changes {
+		mqtt.nodeChangeCallback(change.nodename, change.status, change.uptime)
+	}
+}
+//
+// the known nodes, sorted by name
+//
+func (mqtt *Mqtt) Nodes() []MsgbusNode {
+	mqtt.nodeMutex.Lock()
+	defer mqtt.nodeMutex.Unlock()
+
+	nodes := make([]MsgbusNode, 0, len(mqtt.nodes))
+
+	for nodename, node := range mqtt.nodes {
+		nodes = append(nodes, MsgbusNode{
+			Nodename:	nodename,
+			Status:		node.status.String(),
+			Uptime:		node.uptime,
+			LastSeen:	node.lastSeen.Unix(),
+		})
+	}
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Nodename < nodes[j].Nodename })
+
+	return nodes
+}
@@ -0,0 +1,235 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+	"text/template"
+	"encoding/json"
+	"github.com/mikejac/log.golang"
+)
+
+//
+// outbound HTTP requests made on behalf of MQTT messages, for the IFTTT triggers and the forwarding rules. A
+// worker sends its requests one at a time, optionally rate limited, and retries network errors, 429 and 5xx
+// responses with an exponential backoff. What still fails is handed to deadLetter
+//
+
+const (
+	outboundQueueSize			int = 100
+	outboundInitialBackoff		time.Duration = time.Second
+	outboundMaxBackoff			time.Duration = time.Minute
+)
+
+type outboundRequest struct {
+	rule				string					// name of the trigger or rule, for logging; URLs may contain secrets
+	method				string
+	url					string
+	header				http.Header
+	body				[]byte
+
+	topic				string					// the MQTT message that caused it
+	payload				[]byte
+}
+
+type DeadLetterCallback func(r *outboundRequest, attempts int, err error)
+
+type outboundWorker struct {
+	name				string
+	client				*http.Client
+	retries				int
+	backoff				time.Duration			// before the first retry, doubled for every next one
+	bucket				*tokenBucket			// nil for no rate limit
+	deadLetter			DeadLetterCallback
+	queue				chan *outboundRequest
+	exit				chan bool
+}
+
+// the data available to the templates of triggers and rules
+type mqttMessage struct {
+	Topic				string
+	Payload				interface{}				// the decoded JSON payload, or the payload as a string if it isn't JSON
+	Raw					string
+}
+
+var errOutboundStopped = errors.New("stopped")
+
+//
+//
+func newOutboundWorker(name string, timeout time.Duration, retries int, bucket *tokenBucket, deadLetter DeadLetterCallback) *outboundWorker {
+	return &outboundWorker{
+		name:		name,
+		client:		&http.Client{Timeout: timeout},
+		retries:	retries,
+		backoff:	outboundInitialBackoff,
+		bucket:		bucket,
+		deadLetter:	deadLetter,
+		queue:		make(chan *outboundRequest, outboundQueueSize),
+		exit:		make(chan bool),
+	}
+}
+//
+//
+func (w *outboundWorker) Start() {
+	go w.run()
+}
+//
+//
+func (w *outboundWorker) Stop() {
+	close(w.exit)
+}
+//
+// requests are dropped, and dead lettered, when the queue is full
+//
+func (w *outboundWorker) enqueue(r *outboundRequest) {
+	select {
+	case w.queue <- r:
+	default:
+		log.Infof("outboundWorker::enqueue(): '%s' queue full, dropping '%s' for '%s'", w.name, r.rule, r.topic)
+		w.fail(r, 0, errors.New("queue full"))
+	}
+}
+//
+//
+func (w *outboundWorker) run() {
+	for {
+		select {
+		case r := <- w.queue:
+			if w.bucket != nil {
+				if wait := w.bucket.reserve(); wait > 0 {
+					log.Debugf("outboundWorker::run(): '%s' rate limited; waiting %s", w.name, wait)
+
+					select {
+					case <- time.After(wait):
+					case <- w.exit:
+						return
+					}
+				}
+			}
+
+			if attempts, err := w.send(r); err != nil && err != errOutboundStopped {
+				log.Infof("outboundWorker::run(): '%s' failed after %d attempt(s); %s", r.rule, attempts, err.Error())
+				w.fail(r, attempts, err)
+			}
+
+		case <- w.exit:
+			return
+		}
+	}
+}
+//
+//
+func (w *outboundWorker) send(r *outboundRequest) (attempts int, err error) {
+	backoff := w.backoff
+
+	for {
+		var retry bool
+
+		attempts++
+
+		if retry, err = w.do(r); err == nil {
+			log.Debugf("outboundWorker::send(): '%s' done", r.rule)
+			return attempts, nil
+		}
+
+		if !retry || attempts > w.retries {
+			return attempts, err
+		}
+
+		log.Debugf("outboundWorker::send(): '%s' failed, retrying in %s; %s", r.rule, backoff, err.Error())
+
+		select {
+		case <- time.After(backoff):
+		case <- w.exit:
+			return attempts, errOutboundStopped
+		}
+
+		if backoff *= 2; backoff > outboundMaxBackoff {
+			backoff = outboundMaxBackoff
+		}
+	}
+}
+//
+//
+func (w *outboundWorker) do(r *outboundRequest) (retry bool, err error) {
+	req, err := http.NewRequest(r.method, r.url, bytes.NewReader(r.body))
+	if err != nil {
+		return false, err
+	}
+
+	for name, values := range r.header {
+		req.Header[name] = values
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		// don't pass on the *url.Error, it contains the URL
+		if uerr, ok := err.(*url.Error); ok {
+			err = uerr.Err
+		}
+
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+
+	return retry, fmt.Errorf("endpoint answered %s", resp.Status)
+}
+//
+//
+func (w *outboundWorker) fail(r *outboundRequest, attempts int, err error) {
+	if w.deadLetter != nil {
+		w.deadLetter(r, attempts, err)
+	}
+}
+//
+//
+func newMqttMessage(topic string, payload []byte) mqttMessage {
+	msg := mqttMessage{Topic: topic, Raw: string(payload)}
+
+	if err := json.Unmarshal(payload, &msg.Payload); err != nil {
+		msg.Payload = msg.Raw
+	}
+
+	return msg
+}
+//
+//
+func renderMessageTemplate(tmpl *template.Template, msg mqttMessage) (string, error) {
+	var b bytes.Buffer
+
+	if err := tmpl.Execute(&b, msg); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type deadLettered struct {
+	r					*outboundRequest
+	attempts			int
+	err					error
+}
+
+//
+// answers with statuses in turn, repeating the last one, and counts the requests
+//
+func newStandIn(t *testing.T, statuses ...int) (*httptest.Server, *int32) {
+	var count int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(&count, 1))
+		if n > len(statuses) {
+			n = len(statuses)
+		}
+
+		w.WriteHeader(statuses[n - 1])
+	}))
+	t.Cleanup(server.Close)
+
+	return server, &count
+}
+//
+//
+func newTestWorker(t *testing.T, retries int) (*outboundWorker, chan deadLettered) {
+	dead := make(chan deadLettered, 10)
+
+	w := newOutboundWorker("test", time.Second, retries, nil, func(r *outboundRequest, attempts int, err error) {
+		dead <- deadLettered{r, attempts, err}
+	})
+	w.backoff = time.Millisecond
+
+	w.Start()
+	t.Cleanup(w.Stop)
+
+	return w, dead
+}
+
+func TestOutboundRetries(t *testing.T) {
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusBadGateway} {
+		server, count := newStandIn(t, status, status, http.StatusOK)
+
+		w, dead := newTestWorker(t, 3)
+
+		if _, err := w.send(&outboundRequest{rule: "test", method: http.MethodPost, url: server.URL}); err != nil {
+			t.Errorf("status %d: %v", status, err)
+		}
+
+		if n := atomic.LoadInt32(count); n != 3 {
+			t.Errorf("status %d: %d attempts, want 3", status, n)
+		}
+
+		select {
+		case d := <- dead:
+			t.Errorf("status %d: dead lettered after %d attempts", status, d.attempts)
+		default:
+		}
+	}
+}
+
+func TestOutboundNoRetryOnClientError(t *testing.T) {
+	server, count := newStandIn(t, http.StatusBadRequest)
+
+	w, dead := newTestWorker(t, 3)
+	w.enqueue(&outboundRequest{rule: "test", method: http.MethodPost, url: server.URL, topic: "a/b"})
+
+	select {
+	case d := <- dead:
+		if d.attempts != 1 || d.r.topic != "a/b" {
+			t.Errorf("dead lettered after %d attempts for '%s'", d.attempts, d.r.topic)
+		}
+	case <- time.After(5 * time.Second):
+		t.Fatal("not dead lettered")
+	}
+
+	if n := atomic.LoadInt32(count); n != 1 {
+		t.Errorf("%d attempts, want 1", n)
+	}
+}
+
+func TestOutboundDeadLetter(t *testing.T) {
+	server, count := newStandIn(t, http.StatusInternalServerError)
+
+	w, dead := newTestWorker(t, 2)
+	w.enqueue(&outboundRequest{rule: "test", method: http.MethodPost, url: server.URL})
+
+	select {
+	case d := <- dead:
+		if d.attempts != 3 || d.err == nil {
+			t.Errorf("dead lettered after %d attempts, err = %v", d.attempts, d.err)
+		}
+	case <- time.After(5 * time.Second):
+		t.Fatal("not dead lettered")
+	}
+
+	if n := atomic.LoadInt32(count); n != 3 {
+		t.Errorf("%d attempts, want 3", n)
+	}
+}
+
+func TestOutboundBackoff(t *testing.T) {
+	server, _ := newStandIn(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK)
+
+	w, _ := newTestWorker(t, 3)
+	w.backoff = 20 * time.Millisecond
+
+	start := time.Now()
+
+	if _, err := w.send(&outboundRequest{rule: "test", method: http.MethodPost, url: server.URL}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 20ms, then 40ms
+	if elapsed := time.Since(start); elapsed < 60 * time.Millisecond {
+		t.Errorf("retried after %s, want at least 60ms", elapsed)
+	}
+}
+
+func TestOutboundErrorHidesURL(t *testing.T) {
+	w, _ := newTestWorker(t, 0)
+
+	_, err := w.send(&outboundRequest{rule: "test", method: http.MethodPost, url: "http://127.0.0.1:1/trigger/x/with/key/secret"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error contains the URL: %s", err.Error())
+	}
+}
@@ -0,0 +1,350 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"sync"
+	"time"
+	"encoding/json"
+	"github.com/mikejac/log.golang"
+)
+
+const (
+	outboxDropOldest			string = "oldest"	// make room by discarding the oldest entry
+	outboxDropNewest			string = "newest"	// refuse the incoming entry
+
+	outboxCompactThreshold		int    = 100		// rewrite the file once this many acknowledged records pile up
+)
+
+var errOutboxFull = errors.New("outbox is full")
+
+//
+// Outbox is a persistent FIFO of webhooks that could not be published yet. It is stored as an append-only
+// file of JSON lines; an entry line is written when a webhook is accepted and an 'ack' line when entries
+// are removed from the head of the queue. The file is rewritten once enough acknowledged records pile up
+//
+type Outbox struct {
+	mutex				sync.Mutex
+
+	path				string
+	maxEntries			int
+	maxAge				time.Duration
+	dropPolicy			string
+
+	file				*os.File
+	entries				[]*outboxEntry
+	nextSeq				uint64
+	acked				int				// records in the file that no longer represent a queued entry
+}
+
+type outboxEntry struct {
+	Seq					uint64			`json:"seq,omitempty"`
+	Ack					uint64			`json:"ack,omitempty"`		// every entry up to and including this seq is gone
+	Time				int64			`json:"time,omitempty"`
+	RequestId			string			`json:"requestId,omitempty"`
+	Remote				string			`json:"remote,omitempty"`
+	ApiKey				string			`json:"apiKey,omitempty"`
+	DataId				string			`json:"dataId,omitempty"`
+	Topic				string			`json:"topic,omitempty"`
+	Payload				json.RawMessage	`json:"payload,omitempty"`
+}
+
+//
+//
+func NewOutbox(path string, maxEntries int, maxAge time.Duration, dropPolicy string) (outbox *Outbox, err error) {
+	log.Debugf("NewOutbox(): begin")
+
+	if dropPolicy != outboxDropOldest && dropPolicy != outboxDropNewest {
+		return nil, errors.New("unknown outbox drop policy '" + dropPolicy + "'")
+	}
+
+	outbox = &Outbox{path: path, maxEntries: maxEntries, maxAge: maxAge, dropPolicy: dropPolicy, nextSeq: 1}
+
+	if err = outbox.load(); err != nil {
+		return nil, err
+	}
+
+	outbox.expire()
+
+	// start out with a clean file
+	if err = outbox.compact(); err != nil {
+		return nil, err
+	}
+
+	log.Debugf("NewOutbox(): %d entries pending", len(outbox.entries))
+	log.Debugf("NewOutbox(): end")
+
+	return outbox, nil
+}
+//
+//
+func (outbox *Outbox) Len() int {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+
+	return len(outbox.entries)
+}
+//
+//
+func (outbox *Outbox) Append(event webhookEvent) error {
+	b, err := json.Marshal(event.payload)
+	if err != nil {
+		return err
+	}
+
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+
+	outbox.expire()
+
+	if outbox.maxEntries > 0 && len(outbox.entries) >= outbox.maxEntries {
+		if outbox.dropPolicy == outboxDropNewest {
+			return errOutboxFull
+		}
+
+		log.Infof("Outbox::Append(): full, dropping '%s' (%s)", outbox.entries[0].DataId, outbox.entries[0].RequestId)
+
+		if err := outbox.removeHead(1); err != nil {
+			return err
+		}
+	}
+
+	entry := &outboxEntry{
+		Seq:		outbox.nextSeq,
+		Time:		time.Now().Unix(),
+		RequestId:	event.requestId,
+		Remote:		event.remote,
+		ApiKey:		event.apiKey,
+		DataId:		event.dataId,
+		Topic:		event.topic,
+		Payload:	b,
+	}
+
+	if err := outbox.write(entry); err != nil {
+		return err
+	}
+
+	outbox.entries = append(outbox.entries, entry)
+	outbox.nextSeq++
+
+	return nil
+}
+//
+// returns the oldest entry without removing it, or nil if the outbox is empty
+//
+func (outbox *Outbox) Peek() *outboxEntry {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+
+	outbox.expire()
+
+	if len(outbox.entries) == 0 {
+		return nil
+	}
+
+	return outbox.entries[0]
+}
+//
+// removes the oldest entry, normally after it has been published
+//
+func (outbox *Outbox) Remove() error {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+
+	if len(outbox.entries) == 0 {
+		return nil
+	}
+
+	return outbox.removeHead(1)
+}
+//
+//
+func (entry *outboxEntry) event() webhookEvent {
+	return webhookEvent{
+		requestId:	entry.RequestId,
+		remote:		entry.Remote,
+		apiKey:		entry.ApiKey,
+		dataId:		entry.DataId,
+		topic:		entry.Topic,
+		payload:	entry.Payload,
+	}
+}
+//
+//
+func (outbox *Outbox) Close() error {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+
+	if outbox.file == nil {
+		return nil
+	}
+
+	err := outbox.file.Close()
+	outbox.file = nil
+
+	return err
+}
+
+/******************************************************************************************************************
+ * internals; the caller holds the mutex
+ *
+ */
+
+//
+//
+func (outbox *Outbox) load() error {
+	f, err := os.Open(outbox.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64 * 1024), 16 * 1024 * 1024)
+
+	for scanner.Scan() {
+		var entry outboxEntry
+
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// most likely a line cut short by a crash; nothing after it can be trusted
+			log.Infof("Outbox::load(): ignoring the rest of '%s'; %s", outbox.path, err.Error())
+			break
+		}
+
+		if entry.Ack > 0 {
+			for len(outbox.entries) > 0 && outbox.entries[0].Seq <= entry.Ack {
+				outbox.entries = outbox.entries[1:]
+			}
+		} else if entry.Seq > 0 {
+			outbox.entries = append(outbox.entries, &entry)
+		}
+
+		if entry.Seq >= outbox.nextSeq {
+			outbox.nextSeq = entry.Seq + 1
+		}
+	}
+
+	return scanner.Err()
+}
+//
+//
+func (outbox *Outbox) expire() {
+	if outbox.maxAge <= 0 {
+		return
+	}
+
+	limit := time.Now().Add(-outbox.maxAge).Unix()
+
+	n := 0
+	for n < len(outbox.entries) && outbox.entries[n].Time < limit {
+		log.Infof("Outbox::expire(): dropping '%s' (%s)", outbox.entries[n].DataId, outbox.entries[n].RequestId)
+		n++
+	}
+
+	if n > 0 {
+		if err := outbox.removeHead(n); err != nil {
+			log.Info("Outbox::expire(): err = ", err)
+		}
+	}
+}
+//
+//
+func (outbox *Outbox) removeHead(n int) error {
+	ack := outbox.entries[n - 1].Seq
+
+	outbox.entries = outbox.entries[n:]
+	outbox.acked  += n + 1
+
+	if len(outbox.entries) == 0 || outbox.acked >= outboxCompactThreshold {
+		return outbox.compact()
+	}
+
+	return outbox.write(&outboxEntry{Ack: ack})
+}
+//
+//
+func (outbox *Outbox) write(entry *outboxEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err = outbox.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	return outbox.file.Sync()
+}
+//
+// writes the pending entries to a new file and moves it in place of the old one
+//
+func (outbox *Outbox) compact() error {
+	tmp := outbox.path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE | os.O_TRUNC | os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+
+	for _, entry := range outbox.entries {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		w.Write(append(b, '\n'))
+	}
+
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+
+	f.Close()
+
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmp, outbox.path); err != nil {
+		return err
+	}
+
+	if outbox.file != nil {
+		outbox.file.Close()
+	}
+
+	if outbox.file, err = os.OpenFile(outbox.path, os.O_APPEND | os.O_WRONLY, 0600); err != nil {
+		return err
+	}
+
+	outbox.acked = 0
+
+	return nil
+}
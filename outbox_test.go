@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//
+//
+func newTestOutbox(t *testing.T, path string, maxEntries int, maxAge time.Duration, dropPolicy string) *Outbox {
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "outbox")
+	}
+
+	outbox, err := NewOutbox(path, maxEntries, maxAge, dropPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { outbox.Close() })
+
+	return outbox
+}
+//
+//
+func appendEvents(t *testing.T, outbox *Outbox, from int, to int) {
+	for i := from; i <= to; i++ {
+		if err := outbox.Append(webhookEvent{requestId: "r" + strconv.Itoa(i), dataId: "x", payload: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+//
+// the request IDs of the queued entries, oldest first
+//
+func queued(outbox *Outbox) string {
+	outbox.mutex.Lock()
+	defer outbox.mutex.Unlock()
+
+	ids := make([]string, len(outbox.entries))
+	for i, entry := range outbox.entries {
+		ids[i] = entry.RequestId
+	}
+
+	return strings.Join(ids, ",")
+}
+//
+//
+func fileLines(t *testing.T, path string) int {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Count(string(b), "\n")
+}
+
+func TestOutboxKeepsEvent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+
+	outbox, err := NewOutbox(path, 10, time.Hour, outboxDropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := webhookEvent{requestId: "r1", remote: "192.0.2.1", apiKey: "k", dataId: "x", topic: "custom/topic", payload: map[string]string{"a": "b"}}
+
+	if err := outbox.Append(in); err != nil {
+		t.Fatal(err)
+	}
+
+	outbox.Close()
+
+	// and again after a restart
+	if outbox, err = NewOutbox(path, 10, time.Hour, outboxDropOldest); err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+
+	entry := outbox.Peek()
+	if entry == nil {
+		t.Fatal("outbox empty")
+	}
+
+	out := entry.event()
+
+	if out.topic != in.topic || out.dataId != in.dataId || out.apiKey != in.apiKey || out.requestId != in.requestId || out.remote != in.remote {
+		t.Errorf("event = %+v", out)
+	}
+}
+
+func TestOutboxAckReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+
+	outbox := newTestOutbox(t, path, 10, time.Hour, outboxDropOldest)
+	appendEvents(t, outbox, 1, 3)
+
+	if err := outbox.Remove(); err != nil {
+		t.Fatal(err)
+	}
+
+	// three entries and an ack
+	if n := fileLines(t, path); n != 4 {
+		t.Errorf("%d lines in the file, want 4", n)
+	}
+
+	outbox.Close()
+
+	outbox = newTestOutbox(t, path, 10, time.Hour, outboxDropOldest)
+
+	if q := queued(outbox); q != "r2,r3" {
+		t.Errorf("after a restart: %s, want r2,r3", q)
+	}
+
+	// the sequence goes on where it was
+	appendEvents(t, outbox, 4, 4)
+	outbox.Remove()
+	outbox.Close()
+
+	if q := queued(newTestOutbox(t, path, 10, time.Hour, outboxDropOldest)); q != "r3,r4" {
+		t.Errorf("after a second restart: %s, want r3,r4", q)
+	}
+}
+
+func TestOutboxCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+
+	outbox := newTestOutbox(t, path, 1000, time.Hour, outboxDropOldest)
+	appendEvents(t, outbox, 1, 200)
+
+	for i := 0; i < 150; i++ {
+		if err := outbox.Remove(); err != nil {
+			t.Fatal(err)
+		}
+
+		if n := fileLines(t, path); n > outbox.Len() + 2 * outboxCompactThreshold {
+			t.Fatalf("%d lines in the file for %d entries", n, outbox.Len())
+		}
+	}
+
+	for outbox.Len() > 0 {
+		outbox.Remove()
+	}
+
+	if n := fileLines(t, path); n != 0 {
+		t.Errorf("%d lines in the file of an empty outbox", n)
+	}
+}
+
+func TestOutboxDropPolicy(t *testing.T) {
+	oldest := newTestOutbox(t, "", 2, time.Hour, outboxDropOldest)
+	appendEvents(t, oldest, 1, 3)
+
+	if q := queued(oldest); q != "r2,r3" {
+		t.Errorf("drop oldest: %s, want r2,r3", q)
+	}
+
+	newest := newTestOutbox(t, "", 2, time.Hour, outboxDropNewest)
+	appendEvents(t, newest, 1, 2)
+
+	if err := newest.Append(webhookEvent{requestId: "r3"}); err != errOutboxFull {
+		t.Errorf("drop newest: err = %v", err)
+	}
+
+	if q := queued(newest); q != "r1,r2" {
+		t.Errorf("drop newest: %s, want r1,r2", q)
+	}
+
+	if _, err := NewOutbox(filepath.Join(t.TempDir(), "outbox"), 2, time.Hour, "random"); err == nil {
+		t.Error("unknown drop policy accepted")
+	}
+}
+
+func TestOutboxExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+
+	outbox := newTestOutbox(t, path, 10, time.Minute, outboxDropOldest)
+	appendEvents(t, outbox, 1, 3)
+
+	outbox.mutex.Lock()
+	outbox.entries[0].Time -= 120
+	outbox.entries[1].Time -= 120
+	outbox.mutex.Unlock()
+
+	if entry := outbox.Peek(); entry == nil || entry.RequestId != "r3" {
+		t.Fatalf("head = %+v, want r3", entry)
+	}
+
+	outbox.Close()
+
+	if q := queued(newTestOutbox(t, path, 10, time.Minute, outboxDropOldest)); q != "r3" {
+		t.Errorf("after a restart: %s, want r3", q)
+	}
+}
+
+func TestOutboxTruncatedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox")
+
+	text := `{"seq":1,"time":` + strconv.FormatInt(time.Now().Unix(), 10) + `,"requestId":"r1","dataId":"x","payload":1}` + "\n" + `{"seq":2,"ti`
+
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	outbox := newTestOutbox(t, path, 10, time.Hour, outboxDropOldest)
+
+	if q := queued(outbox); q != "r1" {
+		t.Errorf("queued = %s, want r1", q)
+	}
+
+	appendEvents(t, outbox, 2, 2)
+
+	if entry := outbox.entries[1]; entry.Seq != 2 {
+		t.Errorf("seq = %d, want 2", entry.Seq)
+	}
+}
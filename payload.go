@@ -0,0 +1,259 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"time"
+	"net/url"
+	"net/http"
+	"encoding/json"
+)
+
+const (
+	contentTypeJSON				string = "application/json"
+	contentTypeForm				string = "application/x-www-form-urlencoded"
+	contentTypeText				string = "text/plain"
+)
+
+const (
+	payloadModeLocation			string = "location"		// decode into Location{Who, Area, Type, ApiKey}
+	payloadModePassthrough		string = "passthrough"	// forward the payload unchanged; see publishProperties()
+	payloadModeEnriched			string = "enriched"		// forward the payload with a '_meta' object added
+)
+
+var (
+	errUnsupportedContentType	= errors.New("unsupported content type")
+	errTrailingData				= errors.New("unexpected data after JSON value")
+)
+
+//
+//
+func isValidPayloadMode(mode string) bool {
+	switch mode {
+	case payloadModeLocation, payloadModePassthrough, payloadModeEnriched:
+		return true
+	}
+
+	return false
+}
+
+//
+// IFTTT's "Make a web request" action lets the applet author pick the method and the content type, so we
+// accept JSON, form-encoded and plain text bodies. A request without a body (usually a GET) takes its
+// values from the query string instead
+//
+func decodeLocation(r *http.Request, body []byte) (location Location, err error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return locationFromValues(r.URL.Query()), nil
+	}
+
+	mediaType, err := requestMediaType(r)
+	if err != nil {
+		return location, err
+	}
+
+	switch mediaType {
+	case contentTypeJSON:
+		err = json.Unmarshal(body, &location)
+
+	case contentTypeForm:
+		location, err = locationFromForm(body)
+
+	case contentTypeText:
+		// the body is whatever the applet author typed in, so it may be either JSON or key=value pairs
+		if json.Valid(body) {
+			err = json.Unmarshal(body, &location)
+		} else {
+			location, err = locationFromForm(bytes.TrimSpace(body))
+		}
+
+	default:
+		err = errUnsupportedContentType
+	}
+
+	return location, err
+}
+//
+// a missing Content-Type header is treated as JSON, which is what the bridge always expected
+//
+func requestMediaType(r *http.Request) (string, error) {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return contentTypeJSON, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return "", errUnsupportedContentType
+	}
+
+	return mediaType, nil
+}
+//
+//
+func locationFromForm(body []byte) (Location, error) {
+	values, err := url.ParseQuery(string(body))
+	if err != nil {
+		return Location{}, err
+	}
+
+	return locationFromValues(values), nil
+}
+//
+//
+func locationFromValues(values url.Values) Location {
+	return Location{
+		Who:	values.Get("who"),
+		Area:	values.Get("area"),
+		Type:	values.Get("type"),
+	}
+}
+
+/******************************************************************************************************************
+ * generic payloads
+ *
+ */
+
+// eventMeta is added to enriched payloads so subscribers can tell where an event came from
+type eventMeta struct {
+	RequestId	string	`json:"requestId"`
+	ApiKey		string	`json:"apiKey"`
+	DataId		string	`json:"dataId"`
+	Received	int64	`json:"received"`
+	Remote		string	`json:"remote"`
+}
+
+//
+//
+func newEventMeta(remote string, requestId string, apiKey string, dataId string) eventMeta {
+	return eventMeta{
+		RequestId:	requestId,
+		ApiKey:		apiKey,
+		DataId:		dataId,
+		Received:	time.Now().Unix(),
+		Remote:		remote,
+	}
+}
+//
+// same content type rules as decodeLocation, but the payload is kept as whatever JSON value was sent (objects,
+// arrays, numbers, ...). Plain text that isn't JSON is forwarded as a string
+//
+func decodePayload(r *http.Request, body []byte) (interface{}, error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return payloadFromValues(r.URL.Query()), nil
+	}
+
+	mediaType, err := requestMediaType(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mediaType {
+	case contentTypeJSON:
+		return decodeJSON(body)
+
+	case contentTypeForm:
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+
+		return payloadFromValues(values), nil
+
+	case contentTypeText:
+		if json.Valid(body) {
+			return decodeJSON(body)
+		}
+
+		return string(body), nil
+	}
+
+	return nil, errUnsupportedContentType
+}
+//
+// true if decodePayload() took the payload from key=value pairs, in which case every value is a string
+//
+func isFormPayload(r *http.Request, body []byte) bool {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return true
+	}
+
+	mediaType, err := requestMediaType(r)
+
+	return err == nil && mediaType == contentTypeForm
+}
+//
+// numbers are kept as json.Number so they are forwarded exactly as received
+//
+func decodeJSON(body []byte) (payload interface{}, err error) {
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+
+	if err = d.Decode(&payload); err != nil {
+		return nil, err
+	}
+
+	if _, err = d.Token(); err != io.EOF {
+		return nil, errTrailingData
+	}
+
+	return payload, nil
+}
+//
+// a key given once becomes a string, a repeated key becomes an array of strings
+//
+func payloadFromValues(values url.Values) map[string]interface{} {
+	payload := make(map[string]interface{}, len(values))
+
+	for k, v := range values {
+		if len(v) == 1 {
+			payload[k] = v[0]
+		} else {
+			a := make([]interface{}, len(v))
+			for i := range v {
+				a[i] = v[i]
+			}
+
+			payload[k] = a
+		}
+	}
+
+	return payload
+}
+//
+// objects get a '_meta' member, anything else is wrapped as {"value": ..., "_meta": ...}
+//
+func enrichPayload(payload interface{}, meta eventMeta) interface{} {
+	if m, ok := payload.(map[string]interface{}); ok {
+		m["_meta"] = meta
+		return m
+	}
+
+	return map[string]interface{}{
+		"value":	payload,
+		"_meta":	meta,
+	}
+}
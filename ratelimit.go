@@ -0,0 +1,222 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+//
+// a token bucket holding up to burst tokens, refilled at rate tokens per second
+//
+type tokenBucket struct {
+	mutex				sync.Mutex
+	rate				float64
+	burst				float64
+	tokens				float64
+	last				time.Time
+}
+
+//
+//
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+//
+//
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+
+	b.last = now
+}
+//
+// takes a token, borrowing it from the future if need be, and returns how long to wait before using it
+//
+func (b *tokenBucket) reserve() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(time.Now())
+
+	b.tokens--
+
+	if b.tokens >= 0 || b.rate <= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+//
+// takes a token if there is one, or says how long until there is
+//
+func (b *tokenBucket) take() (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(time.Now())
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	if b.rate <= 0 {
+		return false, time.Hour
+	}
+
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+//
+//
+func (b *tokenBucket) setLimit(rate float64, burst int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.rate  = rate
+	b.burst = math.Max(float64(burst), 1)
+}
+//
+//
+func (b *tokenBucket) state() (tokens float64, full bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(time.Now())
+
+	return b.tokens, b.tokens >= b.burst
+}
+
+/******************************************************************************************************************
+ * webhook rate limits
+ *
+ */
+
+//
+// a rate of requests per minute with a burst; a zero rate is no limit
+//
+type rateLimit struct {
+	rate				float64
+	burst				int
+}
+
+// one bucket per client IP, API key or data ID
+type bucketSet struct {
+	mutex				sync.Mutex
+	buckets				map[string]*tokenBucket
+	lastPrune			time.Time
+}
+
+// the limits themselves come from the configuration, which can be reloaded; the buckets stay
+type rateLimiter struct {
+	ip					bucketSet
+	key					bucketSet
+	dataId				bucketSet
+}
+
+// a bucket as shown by the 'stats' RPC
+type bucketState struct {
+	Tokens				float64			`json:"tokens"`
+	Rate				float64			`json:"rate"`
+	Burst				int				`json:"burst"`
+}
+
+const (
+	bucketPruneInterval		time.Duration = time.Minute
+)
+
+//
+//
+func newRateLimiter() *rateLimiter {
+	limiter := &rateLimiter{}
+
+	for _, set := range []*bucketSet{&limiter.ip, &limiter.key, &limiter.dataId} {
+		set.buckets   = make(map[string]*tokenBucket)
+		set.lastPrune = time.Now()
+	}
+
+	return limiter
+}
+//
+// false and how long to wait if id is over its limit
+//
+func (set *bucketSet) take(id string, limit rateLimit) (bool, time.Duration) {
+	if limit.rate <= 0 {
+		return true, 0
+	}
+
+	set.mutex.Lock()
+
+	if time.Since(set.lastPrune) > bucketPruneInterval {
+		set.prune()
+	}
+
+	bucket, ok := set.buckets[id]
+	if !ok {
+		bucket = newTokenBucket(limit.rate / 60, limit.burst)
+		set.buckets[id] = bucket
+	}
+
+	set.mutex.Unlock()
+
+	bucket.setLimit(limit.rate / 60, limit.burst)
+
+	return bucket.take()
+}
+//
+// full buckets are the same as new ones, so there's no point keeping them around. Called with the mutex held
+//
+func (set *bucketSet) prune() {
+	for id, bucket := range set.buckets {
+		if _, full := bucket.state(); full {
+			delete(set.buckets, id)
+		}
+	}
+
+	set.lastPrune = time.Now()
+}
+//
+//
+func (set *bucketSet) states() map[string]bucketState {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+
+	states := make(map[string]bucketState, len(set.buckets))
+
+	for id, bucket := range set.buckets {
+		tokens, _ := bucket.state()
+
+		bucket.mutex.Lock()
+		states[id] = bucketState{Tokens: math.Round(tokens * 100) / 100, Rate: bucket.rate * 60, Burst: int(bucket.burst)}
+		bucket.mutex.Unlock()
+	}
+
+	return states
+}
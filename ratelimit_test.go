@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 2)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take(); !ok {
+			t.Fatalf("take %d refused", i + 1)
+		}
+	}
+
+	ok, wait := b.take()
+	if ok {
+		t.Fatal("third take allowed")
+	}
+
+	if wait <= 0 || wait > 100 * time.Millisecond {
+		t.Errorf("wait = %s, want up to 100ms", wait)
+	}
+
+	time.Sleep(wait + 10 * time.Millisecond)
+
+	if ok, _ := b.take(); !ok {
+		t.Error("take refused after waiting")
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	b := newTokenBucket(10, 1)
+
+	if wait := b.reserve(); wait != 0 {
+		t.Errorf("first reserve waits %s", wait)
+	}
+
+	// the second and third are borrowed from the future
+	if wait := b.reserve(); wait <= 0 || wait > 100 * time.Millisecond {
+		t.Errorf("second reserve waits %s", wait)
+	}
+
+	if wait := b.reserve(); wait <= 100 * time.Millisecond || wait > 200 * time.Millisecond {
+		t.Errorf("third reserve waits %s", wait)
+	}
+}
+
+func TestBucketSet(t *testing.T) {
+	limiter := newRateLimiter()
+	limit := rateLimit{rate: 60, burst: 1}
+
+	if ok, _ := limiter.ip.take("a", limit); !ok {
+		t.Fatal("first request for 'a' refused")
+	}
+
+	if ok, _ := limiter.ip.take("a", limit); ok {
+		t.Error("second request for 'a' allowed")
+	}
+
+	if ok, _ := limiter.ip.take("b", limit); !ok {
+		t.Error("'b' limited by 'a'")
+	}
+
+	for i := 0; i < 10; i++ {
+		if ok, _ := limiter.ip.take("c", rateLimit{}); !ok {
+			t.Fatal("no limit, but refused")
+		}
+	}
+
+	if _, ok := limiter.ip.states()["a"]; !ok {
+		t.Error("'a' missing from the stats")
+	}
+}
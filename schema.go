@@ -0,0 +1,271 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+	"encoding/json"
+	"github.com/go-ini/ini"
+)
+
+const (
+	schemaTypeString			string = "string"
+	schemaTypeNumber			string = "number"
+	schemaTypeInteger			string = "integer"
+	schemaTypeBool				string = "bool"
+	schemaTypeObject			string = "object"
+	schemaTypeArray				string = "array"
+	schemaTypeAny				string = "any"
+)
+
+//
+// a schema is declared as a [schema.<name>] section with one key per field, e.g.
+//
+//   [schema.location]
+//   who  = string,required,maxlen=64
+//   area = string,required
+//   type = string,required,enum=entered|exited
+//
+type PayloadSchema struct {
+	name				string
+	fields				[]*schemaField
+}
+
+type schemaField struct {
+	name				string
+	fieldType			string
+	required			bool
+	enum				[]string
+	maxLength			int
+}
+
+// validationError carries every violation found, not just the first one
+type validationError struct {
+	violations			[]string
+}
+
+func (e *validationError) Error() string {
+	return "payload validation failed: " + strings.Join(e.violations, "; ")
+}
+
+//
+//
+func newPayloadSchema(section *ini.Section) (schema *PayloadSchema, err error) {
+	schema = &PayloadSchema{name: strings.TrimPrefix(section.Name(), "schema.")}
+
+	for _, key := range section.Keys() {
+		field, err := newSchemaField(key.Name(), key.String())
+		if err != nil {
+			return nil, fmt.Errorf("[%s] %s", section.Name(), err.Error())
+		}
+
+		schema.fields = append(schema.fields, field)
+	}
+
+	return schema, nil
+}
+//
+//
+func newSchemaField(name string, spec string) (field *schemaField, err error) {
+	field = &schemaField{name: name, fieldType: schemaTypeAny}
+
+	for _, attr := range strings.Split(spec, ",") {
+		attr = strings.TrimSpace(attr)
+
+		switch {
+		case attr == "":
+			continue
+
+		case attr == "required":
+			field.required = true
+
+		case strings.HasPrefix(attr, "maxlen="):
+			if field.maxLength, err = strconv.Atoi(strings.TrimPrefix(attr, "maxlen=")); err != nil || field.maxLength < 0 {
+				return nil, fmt.Errorf("field '%s': invalid maxlen '%s'", name, attr)
+			}
+
+		case strings.HasPrefix(attr, "enum="):
+			field.enum = strings.Split(strings.TrimPrefix(attr, "enum="), "|")
+
+		case isValidSchemaType(attr):
+			field.fieldType = attr
+
+		default:
+			return nil, fmt.Errorf("field '%s': unknown attribute '%s'", name, attr)
+		}
+	}
+
+	return field, nil
+}
+//
+//
+func isValidSchemaType(t string) bool {
+	switch t {
+	case schemaTypeString, schemaTypeNumber, schemaTypeInteger, schemaTypeBool, schemaTypeObject, schemaTypeArray, schemaTypeAny:
+		return true
+	}
+
+	return false
+}
+//
+// payload is expected to come from decodePayload, i.e. numbers are json.Number
+//
+func (schema *PayloadSchema) Validate(payload interface{}) error {
+	m, ok := payload.(map[string]interface{})
+	if !ok {
+		return &validationError{violations: []string{"payload must be a JSON object"}}
+	}
+
+	var violations []string
+
+	for _, field := range schema.fields {
+		value, present := m[field.name]
+		if !present || value == nil {
+			if field.required {
+				violations = append(violations, fmt.Sprintf("field '%s': required", field.name))
+			}
+			continue
+		}
+
+		violations = append(violations, field.validate(value)...)
+	}
+
+	if len(violations) > 0 {
+		return &validationError{violations: violations}
+	}
+
+	return nil
+}
+//
+// form and query string values are all strings; those of number, integer and bool fields are converted to what
+// the same field would have been in a JSON body. Values that don't convert are left for Validate() to report
+//
+func (schema *PayloadSchema) convertForm(payload interface{}) interface{} {
+	m, ok := payload.(map[string]interface{})
+	if !ok {
+		return payload
+	}
+
+	for _, field := range schema.fields {
+		s, ok := m[field.name].(string)
+		if !ok {
+			continue
+		}
+
+		switch field.fieldType {
+		case schemaTypeNumber, schemaTypeInteger:
+			// only what JSON accepts as a number, so no 'NaN' or '0x10'
+			var n json.Number
+			if err := json.Unmarshal([]byte(s), &n); err == nil {
+				m[field.name] = n
+			}
+
+		case schemaTypeBool:
+			if b, err := strconv.ParseBool(s); err == nil {
+				m[field.name] = b
+			}
+		}
+	}
+
+	return m
+}
+//
+//
+func (field *schemaField) validate(value interface{}) (violations []string) {
+	if actual := jsonTypeOf(value); !field.acceptsType(actual) {
+		return []string{fmt.Sprintf("field '%s': expected %s, got %s", field.name, field.fieldType, actual)}
+	}
+
+	if field.maxLength > 0 {
+		var length int
+
+		switch v := value.(type) {
+		case string:
+			length = utf8.RuneCountInString(v)
+		case []interface{}:
+			length = len(v)
+		}
+
+		if length > field.maxLength {
+			violations = append(violations, fmt.Sprintf("field '%s': length %d exceeds maximum %d", field.name, length, field.maxLength))
+		}
+	}
+
+	if len(field.enum) > 0 {
+		s := fmt.Sprint(value)
+
+		found := false
+		for _, e := range field.enum {
+			if e == s {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			violations = append(violations, fmt.Sprintf("field '%s': '%s' is not one of '%s'", field.name, s, strings.Join(field.enum, "|")))
+		}
+	}
+
+	return violations
+}
+//
+//
+func (field *schemaField) acceptsType(actual string) bool {
+	switch field.fieldType {
+	case schemaTypeAny:
+		return true
+	case schemaTypeNumber:
+		return actual == schemaTypeNumber || actual == schemaTypeInteger
+	}
+
+	return field.fieldType == actual
+}
+//
+//
+func jsonTypeOf(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return schemaTypeString
+	case bool:
+		return schemaTypeBool
+	case map[string]interface{}:
+		return schemaTypeObject
+	case []interface{}:
+		return schemaTypeArray
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return schemaTypeInteger
+		}
+		return schemaTypeNumber
+	case float64:
+		if v == float64(int64(v)) {
+			return schemaTypeInteger
+		}
+		return schemaTypeNumber
+	}
+
+	return "null"
+}
@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"encoding/json"
+)
+
+//
+//
+func newTestSchema(t *testing.T, fields map[string]string) *PayloadSchema {
+	schema := &PayloadSchema{name: "test"}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field, err := newSchemaField(name, fields[name])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		schema.fields = append(schema.fields, field)
+	}
+
+	return schema
+}
+//
+//
+func violations(err error) []string {
+	if verr, ok := err.(*validationError); ok {
+		return verr.violations
+	}
+
+	return nil
+}
+
+func TestSchemaValidate(t *testing.T) {
+	schema := newTestSchema(t, map[string]string{
+		"who":		"string,required,maxlen=4",
+		"type":		"string,required,enum=entered|exited",
+		"count":	"integer",
+		"level":	"number",
+		"armed":	"bool",
+		"tags":		"array,maxlen=2",
+	})
+
+	tests := []struct {
+		name			string
+		payload			string
+		violations		int
+	}{
+		{"valid",			`{"who": "me", "type": "entered", "count": 3, "level": 2.5, "armed": true, "tags": ["a"]}`,	0},
+		{"integer number",	`{"who": "me", "type": "exited", "level": 2}`,												0},
+		{"required",		`{"who": "me"}`,																			1},
+		{"null is missing",	`{"who": "me", "type": null}`,																1},
+		{"enum",			`{"who": "me", "type": "left"}`,															1},
+		{"maxlen",			`{"who": "someone", "type": "entered"}`,													1},
+		{"maxlen array",	`{"who": "me", "type": "entered", "tags": ["a", "b", "c"]}`,								1},
+		{"type",			`{"who": "me", "type": "entered", "count": 2.5}`,											1},
+		{"several",			`{"who": 7, "count": "x", "armed": "yes"}`,												4},
+	}
+
+	for _, tt := range tests {
+		payload, err := decodeJSON([]byte(tt.payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := violations(schema.Validate(payload)); len(got) != tt.violations {
+			t.Errorf("%s: violations = %q, want %d", tt.name, got, tt.violations)
+		}
+	}
+
+	if err := schema.Validate("a string"); len(violations(err)) != 1 {
+		t.Errorf("not an object: err = %v", err)
+	}
+}
+
+func TestSchemaFieldSpec(t *testing.T) {
+	for _, spec := range []string{"strin", "maxlen=x", "maxlen=-1", "string,required,bogus"} {
+		if _, err := newSchemaField("f", spec); err == nil {
+			t.Errorf("'%s' accepted", spec)
+		}
+	}
+}
+
+func TestSchemaForm(t *testing.T) {
+	schema := newTestSchema(t, map[string]string{
+		"count":	"integer,required",
+		"level":	"number",
+		"armed":	"bool",
+		"name":		"string",
+	})
+
+	form := url.Values{"count": {"3"}, "level": {"2.5"}, "armed": {"true"}, "name": {"42"}}
+
+	r := httptest.NewRequest("POST", "/ifttt/x", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", contentTypeForm)
+
+	body := []byte(form.Encode())
+
+	if !isFormPayload(r, body) {
+		t.Fatal("not taken for a form")
+	}
+
+	payload, err := decodePayload(r, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload = schema.convertForm(payload)
+
+	if err := schema.Validate(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := json.Marshal(payload)
+	if want := `{"armed":true,"count":3,"level":2.5,"name":"42"}`; string(b) != want {
+		t.Errorf("payload = %s, want %s", b, want)
+	}
+
+	for _, bad := range []string{"count=x", "count=NaN", "count=0x10", "count=1&armed=maybe"} {
+		values, _ := url.ParseQuery(bad)
+
+		if err := schema.Validate(schema.convertForm(payloadFromValues(values))); err == nil {
+			t.Errorf("'%s' accepted", bad)
+		}
+	}
+}
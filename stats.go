@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+//
+// counters are updated from both the HTTP handlers and the dispatcher, so always through add()
+//
+type dispatcherStats struct {
+	accepted			int64				// webhooks that passed validation
+	rejected			int64				// webhooks answered with an error
+	published			int64				// updates published, including those replayed from the outbox
+	queued				int64				// updates put in the outbox
+	failed				int64				// updates that could be neither published nor queued
+	limited				int64				// webhooks refused with 429
+	banned				int64				// client addresses banned after too many failed attempts
+}
+
+// the reply to the msgbus 'stats' RPC
+type statsReport struct {
+	Uptime				int64				`json:"uptime"`
+	Connected			bool				`json:"connected"`
+	Broker				string				`json:"broker,omitempty"`
+	Accepted			int64				`json:"accepted"`
+	Rejected			int64				`json:"rejected"`
+	Published			int64				`json:"published"`
+	Queued				int64				`json:"queued"`
+	Failed				int64				`json:"failed"`
+	Limited				int64				`json:"limited"`
+	Banned				int64				`json:"banned"`
+	Outbox				int					`json:"outbox"`
+	RateLimits			rateLimitReport		`json:"rate_limits"`
+	Bans				map[string]int64	`json:"bans"`			// seconds left per banned address
+}
+
+// the buckets that aren't full
+type rateLimitReport struct {
+	IP					map[string]bucketState	`json:"ip"`
+	Key					map[string]bucketState	`json:"key"`
+	DataId				map[string]bucketState	`json:"dataid"`
+}
+
+//
+//
+func (s *dispatcherStats) add(counter *int64) {
+	atomic.AddInt64(counter, 1)
+}
+//
+//
+func (dispatcher *Dispatcher) statsReport() statsReport {
+	report := statsReport{
+		Uptime:		time.Now().Unix() - dispatcher.startTime.Unix(),
+		Connected:	dispatcher.mqtt.IsConnected(),
+		Broker:		dispatcher.mqtt.ActiveBroker(),
+		Accepted:	atomic.LoadInt64(&dispatcher.stats.accepted),
+		Rejected:	atomic.LoadInt64(&dispatcher.stats.rejected),
+		Published:	atomic.LoadInt64(&dispatcher.stats.published),
+		Queued:		atomic.LoadInt64(&dispatcher.stats.queued),
+		Failed:		atomic.LoadInt64(&dispatcher.stats.failed),
+		Limited:	atomic.LoadInt64(&dispatcher.stats.limited),
+		Banned:		atomic.LoadInt64(&dispatcher.stats.banned),
+		RateLimits:	rateLimitReport{
+			IP:		dispatcher.limiter.ip.states(),
+			Key:	dispatcher.limiter.key.states(),
+			DataId:	dispatcher.limiter.dataId.states(),
+		},
+		Bans:		dispatcher.bans.list(),
+	}
+
+	if dispatcher.outbox != nil {
+		report.Outbox = dispatcher.outbox.Len()
+	}
+
+	return report
+}
@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"text/template"
+	"encoding/json"
+)
+
+//
+// topic templates are Go text/templates used instead of the msgbus layout, e.g.
+//
+//   homeassistant/sensor/{{.ApiKey}}_{{.DataId}}/state
+//   nodered/{{.Payload.area | lower}}/{{.DataId}}
+//
+// a field missing from the payload is an error rather than an empty topic level. Templates see the payload as
+// decoded JSON in every payload mode, so it's '.Payload.area' for a location too. A '/' in a value taken from
+// the payload or the remote address becomes '_', so senders can't add topic levels
+//
+type topicData struct {
+	Domain					string
+	Nodename				string
+	DataId					string
+	ApiKey					string
+	RequestId				string
+	Remote					string
+	Payload					interface{}
+}
+
+// functions for all templates: topics, IFTTT values and forwarding rules
+var templateFuncs = template.FuncMap{
+	"lower":	strings.ToLower,
+	"upper":	strings.ToUpper,
+	"json":		templateJSON,
+}
+
+//
+// {{json .Payload}} gives the payload, or part of it, as JSON
+//
+func templateJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
+
+//
+// for all templates; a missing payload field is an error, rather than "<no value>" ending up in a topic or
+// at the other end of a request
+//
+func parseTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+//
+//
+func renderTopic(tmpl *template.Template, data topicData) (string, error) {
+	var b bytes.Buffer
+
+	payload, err := jsonShaped(data.Payload)
+	if err != nil {
+		return "", err
+	}
+
+	data.Payload	= escapeTopicLevels(payload)
+	data.Remote		= strings.Replace(data.Remote, "/", "_", -1)
+
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	topic := b.String()
+
+	if topic == "" {
+		return "", errors.New("topic template '" + tmpl.Name() + "' gave an empty topic")
+	}
+
+	if strings.ContainsAny(topic, "+#\x00") {
+		return "", errors.New("topic '" + topic + "' contains a wildcard or NUL character")
+	}
+
+	return topic, nil
+}
+
+//
+// payload as it would be decoded from its JSON, e.g. a map instead of a Location. Always a copy
+//
+func jsonShaped(payload interface{}) (v interface{}, err error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	err = d.Decode(&v)
+
+	return v, err
+}
+//
+// replaces '/' in the strings of a decoded JSON value; modifies v
+//
+func escapeTopicLevels(v interface{}) interface{} {
+	switch t := v.(type) {
+	case string:
+		return strings.Replace(t, "/", "_", -1)
+
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = escapeTopicLevels(e)
+		}
+
+	case []interface{}:
+		for i, e := range t {
+			t[i] = escapeTopicLevels(e)
+		}
+	}
+
+	return v
+}
+//
+// MQTT topic filter matching, with '+' matching a single level and '#' matching any number of levels
+//
+func topicMatches(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+
+	// wildcards don't match topics starting with '$'
+	if strings.HasPrefix(topic, "$") && (f[0] == "+" || f[0] == "#") {
+		return false
+	}
+
+	for i := range f {
+		if f[i] == "#" {
+			return true
+		}
+
+		if i >= len(t) {
+			return false
+		}
+
+		if f[i] != "+" && f[i] != t[i] {
+			return false
+		}
+	}
+
+	return len(f) == len(t)
+}
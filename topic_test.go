@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2017 Michael Jacobsen (github.com/mikejac)
+ *
+ * This file is part of esp8266upgrader.golang.
+ *
+ * iftt-mqtt-webhook.golang is free software: you can redistribute
+ * it and/or modify it under the terms of the GNU General Public License
+ * as published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * iftt-mqtt-webhook.golang is distributed in the hope that it will
+ * be useful, but WITHOUT ANY WARRANTY; without even the implied warranty
+ * of MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with esp8266upgrader.golang.  If not,
+ * see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+//
+//
+func renderTestTopic(t *testing.T, text string, data topicData) (string, error) {
+	tmpl, err := parseTemplate("test", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return renderTopic(tmpl, data)
+}
+
+func TestRenderTopicLocation(t *testing.T) {
+	data := topicData{DataId: "x", Payload: Location{Who: "me", Area: "Home", Type: "entered", ApiKey: "phone"}}
+
+	topic, err := renderTestTopic(t, "nodered/{{.Payload.area | lower}}/{{.DataId}}", data)
+	if err != nil || topic != "nodered/home/x" {
+		t.Errorf("topic = '%s', err = %v", topic, err)
+	}
+}
+
+func TestRenderTopicEscapesLevels(t *testing.T) {
+	payload := map[string]interface{}{"area": "a/b/c", "list": []interface{}{"d/e"}}
+
+	data := topicData{DataId: "x", Remote: "a/b", Payload: payload}
+
+	topic, err := renderTestTopic(t, "nodered/{{.Payload.area}}/{{index .Payload.list 0}}/{{.Remote}}/{{.DataId}}", data)
+	if err != nil || topic != "nodered/a_b_c/d_e/a_b/x" {
+		t.Errorf("topic = '%s', err = %v", topic, err)
+	}
+
+	// the payload that's published is left alone
+	if payload["area"] != "a/b/c" {
+		t.Errorf("payload changed to %v", payload)
+	}
+}
+
+func TestRenderTopicErrors(t *testing.T) {
+	data := topicData{DataId: "x", Payload: map[string]interface{}{"area": "+", "empty": ""}}
+
+	for _, text := range []string{"nodered/{{.Payload.nope}}", "nodered/{{.Payload.area}}", "{{.Payload.empty}}", "a/#"} {
+		if topic, err := renderTestTopic(t, text, data); err == nil {
+			t.Errorf("'%s' gave '%s'", text, topic)
+		}
+	}
+}
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		filter			string
+		topic			string
+		match			bool
+	}{
+		{"a/b",		"a/b",		true},
+		{"a/+",		"a/b",		true},
+		{"a/+",		"a/b/c",	false},
+		{"a/#",		"a",		true},
+		{"a/#",		"a/b/c",	true},
+		{"+/b",		"a/b",		true},
+		{"#",		"$SYS/x",	false},
+		{"+/x",		"$SYS/x",	false},
+		{"a/b",		"a/b/c",	false},
+		{"a/b/c",	"a/b",		false},
+	}
+
+	for _, tt := range tests {
+		if got := topicMatches(tt.filter, tt.topic); got != tt.match {
+			t.Errorf("topicMatches('%s', '%s') = %t", tt.filter, tt.topic, got)
+		}
+	}
+}